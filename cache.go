@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"strings"
+	"io/ioutil"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+)
+
+const cache_path = "_data/.oko-cache"
+
+// what the last build saw and wrote, so the
+// next one can tell what changed by content
+// instead of by modification time
+type Build_Manifest struct {
+	// the config and flags the build ran with;
+	// when these change everything is rebuilt
+	Build string `json:"build"`
+
+	// content hashes of every page source by
+	// ID and every plate, snippet, function
+	// and data file by its DepTree name
+	Sources map[string]string `json:"sources"`
+	Support map[string]string `json:"support"`
+
+	// content hashes of every output by its
+	// path inside the output directory
+	Outputs map[string]string `json:"outputs"`
+
+	Deps map[string][]string `json:"deps"`
+
+	// the page IDs of outputs a permalink put
+	// somewhere else, by output target
+	Targets map[string]string `json:"targets"`
+
+	// function results by page, position and
+	// name, see do_single_function
+	Functions map[string]*Function_Record `json:"functions"`
+}
+
+var LastBuild = new_manifest()
+var NextBuild = new_manifest()
+
+var manifest_mutex sync.Mutex
+
+// hashes of files read during this build,
+// so pages sharing a source read it once
+var file_hashes = make(map[string]string)
+
+func new_manifest() *Build_Manifest {
+	return &Build_Manifest{
+		Sources: make(map[string]string),
+		Support: make(map[string]string),
+		Outputs: make(map[string]string),
+		Deps:    make(map[string][]string),
+		Targets: make(map[string]string),
+
+		Functions: make(map[string]*Function_Record),
+	}
+}
+
+// a missing or broken cache is the same as
+// no cache: everything is compared against
+// nothing and rebuilt
+func load_manifest() {
+	LastBuild   = new_manifest()
+	NextBuild   = new_manifest()
+	file_hashes = make(map[string]string)
+
+	FunctionChanged = make(map[string]bool)
+
+	NextBuild.Build = build_fingerprint()
+
+	if !file_exists(cache_path) {
+		return
+	}
+
+	var m Build_Manifest
+
+	if err := json.Unmarshal(load_file_bytes(cache_path), &m); err != nil {
+		return
+	}
+
+	if m.Sources != nil { LastBuild.Sources = m.Sources }
+	if m.Support != nil { LastBuild.Support = m.Support }
+	if m.Outputs != nil { LastBuild.Outputs = m.Outputs }
+	if m.Deps    != nil { LastBuild.Deps    = m.Deps    }
+	if m.Targets != nil { LastBuild.Targets = m.Targets }
+
+	if m.Functions != nil { LastBuild.Functions = m.Functions }
+
+	LastBuild.Build = m.Build
+}
+
+func save_manifest() {
+	NextBuild.Deps = make(map[string][]string, len(DepTree))
+
+	for k, ids := range DepTree {
+		list := make([]string, len(ids))
+		copy(list, ids)
+		sort.Strings(list)
+
+		NextBuild.Deps[k] = list
+	}
+
+	bytes, err := json.Marshal(NextBuild)
+
+	if err != nil {
+		file_error(cache_path, err.Error())
+		return
+	}
+
+	write_file(cache_path, string(bytes))
+}
+
+// anything that changes every page without
+// touching a source: the config and the flags
+func build_fingerprint() string {
+	var project []byte
+
+	if file_exists("_data/oko.json") {
+		project = load_file_bytes("_data/oko.json")
+	}
+
+	return hash_text(fmt.Sprintf("%s %t %t", project, config.ShowDrafts, config.Serve))
+}
+
+func build_changed() bool {
+	return LastBuild.Build != NextBuild.Build
+}
+
+func hash_text(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// a missing file hashes to ""
+func hash_file(path string) string {
+	if !file_exists(path) {
+		return ""
+	}
+
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// records the hash of every page source,
+// generated pages by the file they came from
+func hash_sources(source map[string]*File_Info) {
+	for _, f := range source {
+		NextBuild.Sources[f.ID] = source_hash(f.Path)
+
+		if f.Target != "" {
+			NextBuild.Targets[f.Target] = f.ID
+		}
+	}
+}
+
+// the ID of the page a deleted output came
+// from, so what depended on that page can
+// still be found after a permalink moved it
+func output_page(target string) string {
+	if id, ok := LastBuild.Targets[target]; ok {
+		return id
+	}
+	return target
+}
+
+func source_hash(path string) string {
+	if h, ok := file_hashes[path]; ok {
+		return h
+	}
+
+	h := hash_file(path)
+	file_hashes[path] = h
+
+	return h
+}
+
+func output_key(path string) string {
+	rel, err := filepath.Rel(config.Output, path)
+
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// a page is rebuilt when its source differs
+// from the last build or when its output is
+// no longer what the last build wrote
+func page_changed(src, dst *File_Info) bool {
+	if old, ok := LastBuild.Sources[src.ID]; !ok || old != NextBuild.Sources[src.ID] {
+		return true
+	}
+
+	path := filepath.Join(config.Output, dst.Path)
+
+	old, ok := LastBuild.Outputs[output_key(path)]
+
+	if !ok || old != hash_file(path) {
+		return true
+	}
+
+	NextBuild.Outputs[output_key(path)] = old
+
+	return false
+}
+
+// the content of support files by name, so
+// changes and deletions are both seen
+func support_changed(name, path string) bool {
+	h := hash_file(path)
+
+	NextBuild.Support[name] = h
+
+	old, ok := LastBuild.Support[name]
+	return !ok || old != h
+}
+
+// support files the last build used that are
+// gone now; whatever used them must rebuild
+func support_removed(pref string) []string {
+	var list []string
+
+	for name := range LastBuild.Support {
+		if _, ok := NextBuild.Support[name]; ok {
+			continue
+		}
+		if strings.HasPrefix(name, pref) {
+			list = append(list, name)
+		}
+	}
+
+	return list
+}
+
+// pages depending on name in this build or
+// the last one; a page that used a deleted
+// page can't say so any more
+func dependents(name string) []string {
+	dep_mutex.Lock()
+	list := append([]string{}, DepTree[name]...)
+	dep_mutex.Unlock()
+
+	return append(list, LastBuild.Deps[name]...)
+}
+
+// writes content unless the output already
+// holds exactly these bytes; reports whether
+// anything was written
+func write_output(path, content string) bool {
+	h := hash_text(content)
+
+	manifest_mutex.Lock()
+	NextBuild.Outputs[output_key(path)] = h
+	manifest_mutex.Unlock()
+
+	if hash_file(path) == h {
+		return false
+	}
+
+	write_file(path, content)
+
+	return true
+}
+
+// a page rendered with errors is still
+// written, but left out of the manifest so
+// the next build renders it and reports its
+// errors again instead of skipping it
+func forget_page(p *Page) {
+	manifest_mutex.Lock()
+	defer manifest_mutex.Unlock()
+
+	delete(NextBuild.Outputs, output_key(p.OutputPath))
+
+	for key := range NextBuild.Functions {
+		if strings.HasPrefix(key, p.ID + "#") {
+			delete(NextBuild.Functions, key)
+		}
+	}
+}
+
+// outputs copied as they are hash the same
+// as their source
+func record_output(path, source string) {
+	manifest_mutex.Lock()
+	NextBuild.Outputs[output_key(path)] = hash_file(source)
+	manifest_mutex.Unlock()
+}
\ No newline at end of file
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"encoding/csv"
+	"encoding/json"
+	"path/filepath"
+)
+
+// _data/data/team.json and _data/data/team.csv
+// are both read as "team"; json files keep
+// their shape, csv files become a list of
+// records keyed by the header row
+//
+// pages read them as ${data.team.lead}, functions
+// as data.team.lead and each blocks iterate
+// them with "each data.team {"
+var Data = make(map[string]interface{})
+
+// content hashes of the files behind Data,
+// for caching what functions make of them
+var DataHashes = make(map[string]string)
+
+const data_root = "_data/data"
+
+func load_data() {
+	Data       = make(map[string]interface{})
+	DataHashes = make(map[string]string)
+
+	list, _ := walk(data_root)
+
+	for _, f := range list {
+		path := filepath.Join(data_root, f.Path)
+		ext  := filepath.Ext(f.Path)
+		name := data_name(f.Path)
+
+		switch ext {
+			case ".json":
+				var v interface{}
+
+				source := load_file_bytes(path)
+
+				if err := json.Unmarshal(source, &v); err != nil {
+					json_error(path, source, err)
+					continue
+				}
+
+				Data[name]       = v
+				DataHashes[name] = hash_text(string(source))
+
+			case ".csv":
+				source := load_file_bytes(path)
+				v, err := load_csv(source)
+
+				if err != nil {
+					file_error(path, "invalid CSV: " + err.Error())
+					continue
+				}
+
+				Data[name]       = v
+				DataHashes[name] = hash_text(string(source))
+		}
+	}
+}
+
+// "team.json" -> "team", "shop/products.csv"
+// -> "shop.products"
+func data_name(path string) string {
+	path = strings.TrimSuffix(filepath.ToSlash(path), filepath.Ext(path))
+	return strings.ReplaceAll(path, "/", ".")
+}
+
+// the file a data name was read from
+func data_path(name string) string {
+	base := filepath.Join(data_root, filepath.FromSlash(strings.ReplaceAll(name, ".", "/")))
+
+	if file_exists(base + ".json") {
+		return base + ".json"
+	}
+	return base + ".csv"
+}
+
+func load_csv(source []byte) ([]interface{}, error) {
+	reader := csv.NewReader(bytes.NewReader(source))
+	reader.TrimLeadingSpace = true
+
+	rows, err := reader.ReadAll()
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]interface{}, 0, len(rows))
+
+	if len(rows) == 0 {
+		return list, nil
+	}
+
+	header := rows[0]
+
+	for _, row := range rows[1:] {
+		record := make(map[string]interface{}, len(header))
+
+		for i, key := range header {
+			if i < len(row) {
+				record[strings.TrimSpace(key)] = row[i]
+			}
+		}
+
+		list = append(list, record)
+	}
+
+	return list, nil
+}
+
+// the data file a dotted path starts in,
+// "shop.products.0.name" -> "shop.products"
+func data_file(key string) (string, string, bool) {
+	best := ""
+
+	for name := range Data {
+		if (key == name || strings.HasPrefix(key, name + ".")) && len(name) > len(best) {
+			best = name
+		}
+	}
+
+	if best == "" {
+		return "", "", false
+	}
+
+	return best, strings.TrimPrefix(key[len(best):], "."), true
+}
+
+// walks a dotted path into the data store;
+// numbers index into lists
+func data_lookup(key string) (interface{}, bool) {
+	name, rest, ok := data_file(key)
+
+	if !ok {
+		return nil, false
+	}
+
+	v := Data[name]
+
+	if rest == "" {
+		return v, true
+	}
+
+	for _, part := range strings.Split(rest, ".") {
+		switch t := v.(type) {
+			case map[string]interface{}:
+				if v, ok = t[part]; !ok {
+					return nil, false
+				}
+
+			case []interface{}:
+				n, err := strconv.Atoi(part)
+
+				if err != nil || n < 0 || n >= len(t) {
+					return nil, false
+				}
+
+				v = t[n]
+
+			default:
+				return nil, false
+		}
+	}
+
+	return v, true
+}
+
+// the text of a data value as a variable;
+// lists of plain values read like list vars
+func data_text(v interface{}) string {
+	switch t := v.(type) {
+		case nil:
+			return ""
+		case string:
+			return t
+		case bool:
+			return strconv.FormatBool(t)
+		case float64:
+			return strconv.FormatFloat(t, 'f', -1, 64)
+
+		case []interface{}:
+			list := make([]string, 0, len(t))
+
+			for _, item := range t {
+				switch item.(type) {
+					case map[string]interface{}, []interface{}:
+						b, _ := json.Marshal(t)
+						return string(b)
+				}
+				list = append(list, data_text(item))
+			}
+
+			return strings.Join(list, ", ")
+	}
+
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// ${data.team.lead}
+func data_value(id string) (string, bool) {
+	if !strings.HasPrefix(id, "data.") {
+		return "", false
+	}
+
+	v, ok := data_lookup(id[5:])
+
+	if !ok {
+		return "", false
+	}
+
+	return data_text(v), true
+}
+
+// the variables of one record, nested keys
+// are joined with dots
+func flatten_data(prefix string, v interface{}, vars map[string]string) {
+	if m, ok := v.(map[string]interface{}); ok {
+		for k, item := range m {
+			if prefix != "" {
+				k = prefix + "." + k
+			}
+			flatten_data(k, item, vars)
+		}
+		return
+	}
+
+	if prefix == "" {
+		prefix = "value"
+	}
+
+	vars[prefix] = data_text(v)
+}
+
+// the records of a data file as pages for an
+// each block; objects are iterated by key
+func data_pages(key string) []*Page {
+	v, ok := data_lookup(key)
+
+	if !ok {
+		return nil
+	}
+
+	var list []*Page
+
+	add := func(n int, k string, item interface{}) {
+		p := &Page{
+			ID:   fmt.Sprintf("data.%s/%06d", key, n),
+			Vars: make(map[string]string, 8),
+		}
+
+		flatten_data("", item, p.Vars)
+
+		if k != "" {
+			p.Vars["key"] = k
+		}
+
+		list = append(list, p)
+	}
+
+	switch t := v.(type) {
+		case []interface{}:
+			for n, item := range t {
+				add(n, "", item)
+			}
+
+		case map[string]interface{}:
+			keys := make([]string, 0, len(t))
+
+			for k := range t {
+				keys = append(keys, k)
+			}
+
+			sort.Strings(keys)
+
+			for n, k := range keys {
+				add(n, k, t[k])
+			}
+
+		default:
+			add(0, "", v)
+	}
+
+	return list
+}
+
+// pages depend on the data files their
+// variables and each blocks read
+func data_dependency(page *Page, key string) {
+	if name, _, ok := data_file(key); ok {
+		n := "data_" + name
+		add_dependency(n, page.ID)
+	}
+}
+
+var data_pattern = regexp.MustCompile(`\bdata(\.[A-Za-z_][\w.]*|\[["'][^"']+["']\])?`)
+
+// functions get the whole store, so their
+// source is searched for the files they use;
+// anything less obvious than data.name or
+// data["name"] depends on every file
+func function_data_files(source string) []string {
+	var list []string
+
+	for _, m := range data_pattern.FindAllStringSubmatch(source, -1) {
+		key := strings.Trim(m[1], `.[]"'`)
+
+		if key == "" {
+			list = list[:0]
+
+			for name := range Data {
+				list = append(list, name)
+			}
+			return list
+		}
+
+		if name, _, ok := data_file(key); ok {
+			list = append(list, name)
+		}
+	}
+
+	return list
+}
+
+func function_data_dependencies(page *Page, source string) {
+	for _, name := range function_data_files(source) {
+		data_dependency(page, name)
+	}
+}
\ No newline at end of file
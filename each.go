@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// each blog/* sort=date desc limit=10 {
+//
+// repeats its block once for every page with
+// an ID matching the pattern, substituting that
+// page's variables into the block; "each
+// data.team {" repeats it for every record of
+// a data file instead
+//
+// paginate=n splits the matches across as many
+// numbered pages as needed, see paginate_pages
+type Each_Args struct {
+	Pattern  string
+	Sort     string
+	Desc     bool
+	Limit    int
+	Paginate int
+}
+
+func parse_each(text string) (*Each_Args, error) {
+	fields := strings.Fields(text)
+
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("each is missing a pattern")
+	}
+
+	args := &Each_Args{Pattern: fields[0]}
+
+	if _, err := path.Match(args.Pattern, ""); err != nil {
+		return nil, fmt.Errorf("bad pattern %q in each", args.Pattern)
+	}
+
+	for _, f := range fields[1:] {
+		switch {
+			case f == "asc":
+				args.Desc = false
+
+			case f == "desc":
+				args.Desc = true
+
+			case strings.HasPrefix(f, "sort="):
+				args.Sort = f[5:]
+
+			case strings.HasPrefix(f, "limit="):
+				n, err := strconv.Atoi(f[6:])
+
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("bad limit %q in each", f[6:])
+				}
+
+				args.Limit = n
+
+			case strings.HasPrefix(f, "paginate="):
+				n, err := strconv.Atoi(f[9:])
+
+				if err != nil || n < 1 {
+					return nil, fmt.Errorf("bad paginate %q in each", f[9:])
+				}
+
+				args.Paginate = n
+
+			default:
+				return nil, fmt.Errorf("unknown argument %q in each", f)
+		}
+	}
+
+	return args, nil
+}
+
+// compares two variables as dates or numbers
+// if both are, otherwise as text
+func compare_vars(a, b string) int {
+	return compare_values(parse_value("", a), parse_value("", b))
+}
+
+func matching_pages(the_page *Page, pattern string) []*Page {
+	var list []*Page
+
+	for id, p := range PageList {
+		if p == the_page || p.Origin != "" || p.ID == the_page.Origin {
+			continue
+		}
+		if p.IsDraft && !config.ShowDrafts {
+			continue
+		}
+		if ok, _ := path.Match(pattern, id); ok {
+			list = append(list, p)
+		}
+	}
+
+	return list
+}
+
+func each_pages(the_page *Page, args *Each_Args) []*Page {
+	var list []*Page
+
+	if strings.HasPrefix(args.Pattern, "data.") {
+		list = data_pages(args.Pattern[5:])
+	} else {
+		list = matching_pages(the_page, args.Pattern)
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		c := 0
+
+		if args.Sort != "" {
+			c = compare_values(typed_var(list[i], args.Sort), typed_var(list[j], args.Sort))
+		}
+		if c == 0 {
+			c = strings.Compare(list[i].ID, list[j].ID)
+		}
+		if args.Desc {
+			return c > 0
+		}
+		return c < 0
+	})
+
+	if args.Limit > 0 && len(list) > args.Limit {
+		list = list[:args.Limit]
+	}
+
+	if args.Paginate > 0 {
+		n, err := strconv.Atoi(the_page.Vars["page_number"])
+
+		if err != nil || n < 1 {
+			n = 1
+		}
+
+		start := (n - 1) * args.Paginate
+		end   := start + args.Paginate
+
+		if start > len(list) {
+			start = len(list)
+		}
+		if end > len(list) {
+			end = len(list)
+		}
+
+		list = list[start:end]
+	}
+
+	return list
+}
+
+func render_each(the_page *Page, tok *Token) string {
+	args, err := parse_each(tok.Text)
+
+	if err != nil {
+		// already reported by the parser
+		skip_block(the_page, tok)
+		return ""
+	}
+
+	list := each_pages(the_page, args)
+
+	if len(list) == 0 {
+		skip_block(the_page, tok)
+		return ""
+	}
+
+	var content strings.Builder
+
+	the_list := the_page.List
+	start    := the_list.Pos
+	outer    := the_page.EachItem
+
+	// the block belongs to the listed page: its
+	// ifs read that page, and a variable it
+	// doesn't have is empty rather than left
+	// for the page the block is written on
+	for _, p := range list {
+		the_list.Pos = start
+		the_page.EachItem = p
+		content.WriteString(mapmap(recurse_render(the_page, tok), page_vars(p), true))
+	}
+
+	the_page.EachItem = outer
+
+	return content.String()
+}
+
+// pages with an each block depend on every
+// page their pattern matches, including ones
+// that were just added or removed
+func each_dependents(id string) []string {
+	var list []string
+
+	for key, ids := range DepTree {
+		if !strings.HasPrefix(key, "each_") {
+			continue
+		}
+		if ok, _ := path.Match(key[5:], id); ok {
+			list = append(list, ids...)
+		}
+	}
+
+	return list
+}
\ No newline at end of file
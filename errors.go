@@ -3,33 +3,272 @@ package main
 import (
 	"os"
 	"fmt"
+	"sort"
+	"sync"
+	"strings"
+	"encoding/json"
 )
 
-var Warnings []string
+// exit codes
+//
+//   0  the build finished; warnings may have been printed
+//   1  the build finished, but pages, plates, snippets,
+//      syntax files or functions contained errors
+//   2  the project could not be loaded because
+//      _data/oko.json is missing or broken
+//   3  oko itself failed - a crash is a bug in oko,
+//      not a problem with the site
+const (
+	EXIT_OK       = 0
+	EXIT_CONTENT  = 1
+	EXIT_PROJECT  = 2
+	EXIT_INTERNAL = 3
+)
+
+type Severity int
+
+const (
+	D_WARNING Severity = iota
+	D_ERROR
+)
+
+var severity_names = [...]string {
+	"warning",
+	"error",
+}
+
+func (s Severity) String() string {
+	return severity_names[s]
+}
+
+type Diagnostic struct {
+	Severity Severity
+	Path     string
+	Line     int
+	Col      int
+	Message  string
+}
+
+var Diagnostics []*Diagnostic
+
+var diagnostic_mutex sync.Mutex
+
+func diagnostic(severity Severity, path string, line, col int, msg string) {
+	diagnostic_mutex.Lock()
+	Diagnostics = append(Diagnostics, &Diagnostic{severity, path, line, col, msg})
+	diagnostic_mutex.Unlock()
+}
 
 func warning(msg string) {
-	Warnings = append(Warnings, msg)
+	diagnostic(D_WARNING, "", 0, 0, msg)
 }
 
 func warning_sprint(msg string, args ...string) {
-	Warnings = append(Warnings, sub_sprint(msg, args...))
+	diagnostic(D_WARNING, "", 0, 0, sub_sprint(msg, args...))
+}
+
+func file_error(path string, msg string) {
+	diagnostic(D_ERROR, path, 0, 0, msg)
+}
+
+// errors and warnings raised while rendering
+// a token are located by the token's line;
+// an error also marks the page, or the page a
+// snippet is rendered into, as failed
+func page_error(the_page *Page, tok *Token, msg string) {
+	diagnostic_mutex.Lock()
+
+	the_page.Failed = true
+
+	if the_page.ID == "" && the_page.CurrentParent != nil {
+		the_page.CurrentParent.Failed = true
+	}
+
+	diagnostic_mutex.Unlock()
+
+	diagnostic(D_ERROR, the_page.SourcePath, tok.Line, 0, msg)
+}
+
+func page_failed(the_page *Page) bool {
+	diagnostic_mutex.Lock()
+	defer diagnostic_mutex.Unlock()
+
+	return the_page.Failed
+}
+
+func page_warning(the_page *Page, tok *Token, msg string) {
+	diagnostic(D_WARNING, the_page.SourcePath, tok.Line, 0, msg)
+}
+
+// reports the ERROR tokens the parser left in
+// a page as soon as it is parsed, so drafts,
+// pages that aren't rendered and parts of a
+// page that never render still report them
+func parse_errors(the_page *Page, list *Token_List) {
+	for _, tok := range list.Tokens {
+		if tok.Type == ERROR {
+			page_error(the_page, tok, tok.Text)
+		}
+	}
+}
+
+// records a failed json.Unmarshal, resolving
+// the byte offset of syntax and type errors to
+// a line and column
+func json_error(path string, source []byte, err error) {
+	offset := int64(-1)
+
+	switch e := err.(type) {
+		case *json.SyntaxError:        offset = e.Offset
+		case *json.UnmarshalTypeError: offset = e.Offset
+	}
+
+	if offset < 0 || offset > int64(len(source)) {
+		file_error(path, "invalid JSON: " + err.Error())
+		return
+	}
+
+	line, col := 1, 1
+
+	for _, r := range string(source[:offset]) {
+		if r == '\n' {
+			line++
+			col = 1
+			continue
+		}
+		col++
+	}
+
+	diagnostic(D_ERROR, path, line, col, "invalid JSON: " + err.Error())
+}
+
+func has_errors() bool {
+	for _, d := range Diagnostics {
+		if d.Severity == D_ERROR {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the text of a single line, or false
+// if the file or the line can't be read
+func source_line(cache map[string][]string, path string, line int) (string, bool) {
+	if path == "" || line < 1 {
+		return "", false
+	}
+
+	lines, ok := cache[path]
+
+	if !ok {
+		if file_exists(path) {
+			lines = strings.Split(string(load_file_bytes(path)), "\n")
+		}
+		cache[path] = lines
+	}
+
+	if line > len(lines) {
+		return "", false
+	}
+
+	return strings.TrimRight(lines[line-1], "\r"), true
 }
 
-func print_warnings() {
-	if len(Warnings) == 0 {
+func print_diagnostic(cache map[string][]string, d *Diagnostic) {
+	location := d.Path
+
+	if location == "" {
+		fmt.Printf("    %s: %s\n", d.Severity, d.Message)
+		return
+	}
+
+	text, has_excerpt := source_line(cache, d.Path, d.Line)
+
+	// tokens don't record a column, but they
+	// always start at the first non-blank rune
+	col := d.Col
+
+	if col == 0 && has_excerpt {
+		col = len([]rune(text)) - len([]rune(strings.TrimLeft(text, " \t"))) + 1
+	}
+
+	if d.Line > 0 {
+		location = fmt.Sprintf("%s:%d:%d", location, d.Line, col)
+	}
+
+	fmt.Printf("    %s: %s: %s\n", location, d.Severity, d.Message)
+
+	if !has_excerpt {
 		return
 	}
 
-	fmt.Println("[ø] warnings\n")
+	// the caret has to line up with the excerpt
+	// once tabs have been expanded
+	var marker strings.Builder
+
+	for i, r := range []rune(text) {
+		if i >= col-1 {
+			break
+		}
+		if r == '\t' {
+			marker.WriteString("    ")
+		} else {
+			marker.WriteByte(' ')
+		}
+	}
+
+	gutter := fmt.Sprintf("%d", d.Line)
+
+	fmt.Printf("    %s | %s\n", gutter, strings.ReplaceAll(text, "\t", "    "))
+	fmt.Printf("    %s | %s^\n", strings.Repeat(" ", len(gutter)), marker.String())
+}
 
-	for _, msg := range Warnings {
-		fmt.Println("   ", msg)
+func print_diagnostics() {
+	if len(Diagnostics) == 0 {
+		return
 	}
 
-	fmt.Println()
+	cache := make(map[string][]string)
+
+	for _, severity := range []Severity{D_WARNING, D_ERROR} {
+		var list []*Diagnostic
+
+		for _, d := range Diagnostics {
+			if d.Severity == severity {
+				list = append(list, d)
+			}
+		}
+
+		if len(list) == 0 {
+			continue
+		}
+
+		// pages render in parallel, so the order
+		// they were found in means nothing
+		sort.SliceStable(list, func(i, j int) bool {
+			if list[i].Path != list[j].Path {
+				return list[i].Path < list[j].Path
+			}
+			if list[i].Line != list[j].Line {
+				return list[i].Line < list[j].Line
+			}
+			return list[i].Message < list[j].Message
+		})
+
+		fmt.Printf("[ø] %ss\n\n", severity)
+
+		for _, d := range list {
+			print_diagnostic(cache, d)
+		}
+
+		fmt.Println()
+	}
 }
 
-func render_error(the_page *Page, tok *Token, msg string) {
-	fmt.Printf("%s L%d: %s %q\n", the_page.ID, tok.Line, msg, tok.Text)
-	os.Exit(1)
+// leaves with EXIT_CONTENT if anything went
+// wrong during the build
+func exit_on_errors() {
+	if has_errors() {
+		os.Exit(EXIT_CONTENT)
+	}
 }
\ No newline at end of file
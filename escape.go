@@ -0,0 +1,330 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// where a substituted value ends up in the
+// HTML around it, which decides how it has to
+// be escaped
+type Escape_Context int
+
+const (
+	E_TEXT Escape_Context = iota
+	E_ATTR
+	E_URL
+	E_RAW // inside <script> or <style>
+)
+
+// attributes whose values are urls
+var url_attributes = map[string]bool {
+	"href":       true,
+	"src":        true,
+	"srcset":     true,
+	"action":     true,
+	"formaction": true,
+	"poster":     true,
+	"cite":       true,
+	"data":       true,
+}
+
+// schemes a substituted url may start with;
+// anything else, javascript: included, is
+// replaced with #
+var safe_schemes = map[string]bool {
+	"http":   true,
+	"https":  true,
+	"mailto": true,
+	"tel":    true,
+	"ftp":    true,
+}
+
+var entity_pattern = regexp.MustCompile(`^&(#[0-9]+|#[xX][0-9a-fA-F]+|[a-zA-Z][a-zA-Z0-9]*);`)
+
+// escapes HTML specials, leaving entities that
+// are already in the text alone so values
+// like "Tom &amp; Jerry" don't double up
+func escape_html(s string, quotes bool) string {
+	if !strings.ContainsAny(s, `&<>'"`) {
+		return s
+	}
+
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+			case '&':
+				if entity_pattern.MatchString(s[i:]) {
+					b.WriteByte(c)
+				} else {
+					b.WriteString("&amp;")
+				}
+			case '<':
+				b.WriteString("&lt;")
+			case '>':
+				b.WriteString("&gt;")
+			case '\'':
+				if quotes {
+					b.WriteString("&#39;")
+				} else {
+					b.WriteByte(c)
+				}
+			case '"':
+				if quotes {
+					b.WriteString("&#34;")
+				} else {
+					b.WriteByte(c)
+				}
+			default:
+				b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+func escape_text(s string) string {
+	return escape_html(s, false)
+}
+
+func escape_attr(s string) string {
+	return escape_html(s, true)
+}
+
+// at the start of a url the scheme is checked,
+// anywhere in it the characters that would
+// end the attribute are percent-encoded
+func escape_url(s string, at_start bool) string {
+	if at_start {
+		t := strings.ToLower(strings.TrimSpace(s))
+
+		if n := strings.IndexRune(t, ':'); n > 0 && !strings.ContainsAny(t[:n], "/?#") {
+			if !safe_schemes[t[:n]] {
+				return "#"
+			}
+		}
+	}
+
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+			case c <= ' ' || c == 0x7f || c == '"' || c == '\'' || c == '<' || c == '>' || c == '`':
+				b.WriteString("%")
+				b.WriteByte("0123456789ABCDEF"[c >> 4])
+				b.WriteByte("0123456789ABCDEF"[c & 15])
+			default:
+				b.WriteByte(c)
+		}
+	}
+
+	return escape_attr(b.String())
+}
+
+// values dropped into scripts and styles are
+// left as they are, except that they can't
+// close the element they are in
+func escape_raw(s string) string {
+	return strings.ReplaceAll(s, "</", `<\/`)
+}
+
+func escape_value(s string, context Escape_Context, at_start bool) string {
+	switch context {
+		case E_ATTR: return escape_attr(s)
+		case E_URL:  return escape_url(s, at_start)
+		case E_RAW:  return escape_raw(s)
+	}
+	return escape_text(s)
+}
+
+// follows just enough HTML to know whether the
+// next byte is text, part of a tag, an
+// attribute value or inside a script
+type Html_Scanner struct {
+	in_tag     bool
+	in_comment bool
+	closing    bool
+
+	tag_name   []byte
+	attr_name  []byte
+	raw_tag    string
+
+	reading_tag  bool
+	reading_attr bool
+	after_equals bool
+	in_value     bool
+	quote        byte
+	value_empty  bool
+}
+
+func is_name_byte(c byte) bool {
+	return c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != '/' && c != '>' && c != '=' && c != '"' && c != '\''
+}
+
+func (h *Html_Scanner) Feed(s string) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		if h.in_comment {
+			if strings.HasSuffix(s[:i+1], "-->") {
+				h.in_comment = false
+			}
+			continue
+		}
+
+		if h.raw_tag != "" && !h.in_tag {
+			if c == '<' && strings.HasPrefix(strings.ToLower(s[i:]), "</" + h.raw_tag) {
+				h.raw_tag = ""
+				h.open_tag()
+			}
+			continue
+		}
+
+		if !h.in_tag {
+			if c == '<' {
+				if strings.HasPrefix(s[i:], "<!--") {
+					h.in_comment = true
+					i += 3
+					continue
+				}
+				if i+1 < len(s) && (s[i+1] == '/' || s[i+1] == '!' || (s[i+1]|0x20 >= 'a' && s[i+1]|0x20 <= 'z')) {
+					h.open_tag()
+				}
+			}
+			continue
+		}
+
+		if h.quote != 0 {
+			if c == h.quote {
+				h.end_value()
+			} else {
+				h.value_empty = false
+			}
+			continue
+		}
+
+		if h.in_value {
+			// unquoted attribute value
+			if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+				h.end_value()
+			} else if c == '>' {
+				h.end_value()
+				h.close_tag()
+			} else {
+				h.value_empty = false
+			}
+			continue
+		}
+
+		switch {
+			case h.reading_tag:
+				if c == '/' && len(h.tag_name) == 0 {
+					h.closing = true
+				} else if is_name_byte(c) {
+					h.tag_name = append(h.tag_name, c|0x20)
+				} else if c == '>' {
+					h.close_tag()
+				} else {
+					h.reading_tag = false
+				}
+
+			case c == '>':
+				h.close_tag()
+
+			case c == '=':
+				h.after_equals = true
+				h.reading_attr = false
+
+			case c == '"' || c == '\'':
+				if h.after_equals {
+					h.quote       = c
+					h.in_value    = true
+					h.value_empty = true
+					h.after_equals = false
+				}
+
+			case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '/':
+				h.reading_attr = false
+
+			default:
+				if h.after_equals {
+					h.in_value     = true
+					h.value_empty  = false
+					h.after_equals = false
+					continue
+				}
+				if !h.reading_attr {
+					h.attr_name    = h.attr_name[:0]
+					h.reading_attr = true
+				}
+				h.attr_name = append(h.attr_name, c|0x20)
+		}
+	}
+}
+
+func (h *Html_Scanner) open_tag() {
+	h.in_tag      = true
+	h.reading_tag = true
+	h.closing     = false
+	h.tag_name    = h.tag_name[:0]
+	h.attr_name   = h.attr_name[:0]
+}
+
+func (h *Html_Scanner) close_tag() {
+	h.in_tag       = false
+	h.reading_tag  = false
+	h.reading_attr = false
+	h.after_equals = false
+
+	if !h.closing {
+		switch string(h.tag_name) {
+			case "script", "style":
+				h.raw_tag = string(h.tag_name)
+		}
+	}
+}
+
+func (h *Html_Scanner) end_value() {
+	h.in_value  = false
+	h.quote     = 0
+	h.attr_name = h.attr_name[:0]
+}
+
+// the context of whatever comes next, and for
+// urls whether it starts the attribute value
+func (h *Html_Scanner) Context() (Escape_Context, bool) {
+	switch {
+		case h.in_comment:
+			return E_TEXT, false
+		case h.raw_tag != "" && !h.in_tag:
+			return E_RAW, false
+		case !h.in_tag:
+			return E_TEXT, false
+		case h.after_equals && url_attributes[string(h.attr_name)]:
+			return E_URL, true
+		case h.in_value && url_attributes[string(h.attr_name)]:
+			return E_URL, h.value_empty
+	}
+	return E_ATTR, false
+}
+
+// sub_sprint for attribute values, each value
+// is escaped before it goes in
+func sub_attr(source string, v ...string) string {
+	parts := strings.Split(source, `%s`)
+
+	var b strings.Builder
+
+	for i, part := range parts {
+		b.WriteString(part)
+
+		if i < len(parts) - 1 && i < len(v) {
+			b.WriteString(escape_attr(v[i]))
+		}
+	}
+
+	return b.String()
+}
\ No newline at end of file
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"sort"
+	"time"
+	"bytes"
+	"strings"
+	"encoding/xml"
+	"encoding/json"
+	"path/filepath"
+)
+
+// "feed": {
+//     "title": "Blog",
+//     "description": "Posts about things",
+//     "sections": ["blog"],
+//     "limit": 20
+// }
+//
+// writes feed.xml (RSS 2.0), atom.xml and
+// feed.json next to the sitemap
+type Feed_Config struct {
+	Title       string
+	Description string
+	Sections    []string
+	Limit       int
+}
+
+var feed_files = []string{`feed.xml`, `atom.xml`, `feed.json`}
+
+type Feed_Entry struct {
+	Title   string
+	URL     string
+	Summary string
+	Content string
+	Date    time.Time
+
+	page *Page
+}
+
+func xml_escape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// root-relative links stop working once the
+// content is read outside the site
+func absolute_links(s string) string {
+	for _, attr := range []string{`href='/`, `src='/`, `href="/`, `src="/`} {
+		s = strings.ReplaceAll(s, attr, attr[:len(attr)-1] + config.Domain + "/")
+	}
+	return s
+}
+
+func in_feed_section(id string) bool {
+	for _, section := range config.Feed.Sections {
+		section = strings.Trim(section, "/")
+
+		if section == "" || id == section || strings.HasPrefix(id, section + "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// whether a change to these pages has to be
+// reflected in the feeds
+func feeds_changed(lists ...map[string]*File_Info) bool {
+	for _, f := range feed_files {
+		if !file_exists(filepath.Join(config.Output, f)) {
+			return true
+		}
+	}
+
+	for _, list := range lists {
+		for id := range list {
+			if in_feed_section(output_page(id)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func feed_entries(source map[string]*File_Info) []*Feed_Entry {
+	var pages []*Page
+
+	for id, page := range PageList {
+		// drafts never make it into a feed, not
+		// even with -drafts
+		if page.IsDraft || page.Origin != "" {
+			continue
+		}
+		if id == "index" || strings.HasSuffix(id, "/index") || !in_feed_section(id) {
+			continue
+		}
+		pages = append(pages, page)
+	}
+
+	entries := make([]*Feed_Entry, 0, len(pages))
+
+	for _, page := range pages {
+		entry := &Feed_Entry{
+			Title:   page.Vars["title"],
+			URL:     config.Domain + page.URLPath,
+			Summary: page.Vars["meta.description"],
+
+			page: page,
+		}
+
+		if t, ok := parse_date(page.Vars["date"]); ok {
+			entry.Date = t
+		} else if f, ok := source[page.ID]; ok {
+			entry.Date = f.Mod
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort_feed(entries)
+
+	limit := config.Feed.Limit
+
+	if limit <= 0 {
+		limit = 20
+	}
+
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	// only the entries that made it in are
+	// rendered
+	for _, entry := range entries {
+		entry.Content = absolute_links(feed_content(entry.page))
+	}
+
+	return entries
+}
+
+// renders a page again for its feed entry;
+// the page's own render has already reported
+// whatever is wrong with it, so nothing this
+// one finds is reported twice
+func feed_content(p *Page) string {
+	diagnostic_mutex.Lock()
+	n := len(Diagnostics)
+	diagnostic_mutex.Unlock()
+
+	content := render_content(p)
+
+	diagnostic_mutex.Lock()
+	Diagnostics = Diagnostics[:n]
+	diagnostic_mutex.Unlock()
+
+	return content
+}
+
+// newest first, pages from the same moment
+// by url so the feed doesn't reshuffle
+func sort_feed(entries []*Feed_Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+
+		if !a.Date.Equal(b.Date) {
+			return a.Date.After(b.Date)
+		}
+		return a.URL < b.URL
+	})
+}
+
+func feed_title() string {
+	if config.Feed.Title != "" {
+		return config.Feed.Title
+	}
+	if config.Title != "" {
+		return config.Title
+	}
+	return strings.TrimPrefix(config.Domain, "https://")
+}
+
+func feed_description() string {
+	if config.Feed.Description != "" {
+		return config.Feed.Description
+	}
+	return config.Meta["description"]
+}
+
+func rss_feed(entries []*Feed_Entry, updated time.Time) string {
+	var b strings.Builder
+
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?><rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom" xmlns:content="http://purl.org/rss/1.0/modules/content/"><channel>`)
+	b.WriteString(sub_content(`<title>%s</title>`,       xml_escape(feed_title())))
+	b.WriteString(sub_content(`<link>%s</link>`,         xml_escape(config.Domain + "/")))
+	b.WriteString(sub_content(`<description>%s</description>`, xml_escape(feed_description())))
+	b.WriteString(sub_content(`<atom:link href="%s" rel="self" type="application/rss+xml"/>`, xml_escape(config.Domain + "/feed.xml")))
+	b.WriteString(sub_content(`<lastBuildDate>%s</lastBuildDate>`, updated.Format(time.RFC1123Z)))
+
+	for _, e := range entries {
+		b.WriteString(`<item>`)
+		b.WriteString(sub_content(`<title>%s</title>`, xml_escape(e.Title)))
+		b.WriteString(sub_content(`<link>%s</link>`,   xml_escape(e.URL)))
+		b.WriteString(sub_content(`<guid isPermaLink="true">%s</guid>`, xml_escape(e.URL)))
+		b.WriteString(sub_content(`<pubDate>%s</pubDate>`, e.Date.Format(time.RFC1123Z)))
+		b.WriteString(sub_content(`<description>%s</description>`, xml_escape(e.Summary)))
+		b.WriteString(sub_content(`<content:encoded>%s</content:encoded>`, xml_escape(e.Content)))
+		b.WriteString(`</item>`)
+	}
+
+	b.WriteString(`</channel></rss>`)
+
+	return b.String()
+}
+
+func atom_feed(entries []*Feed_Entry, updated time.Time) string {
+	var b strings.Builder
+
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?><feed xmlns="http://www.w3.org/2005/Atom">`)
+	b.WriteString(sub_content(`<title>%s</title>`, xml_escape(feed_title())))
+	b.WriteString(sub_content(`<subtitle>%s</subtitle>`, xml_escape(feed_description())))
+	b.WriteString(sub_content(`<id>%s</id>`, xml_escape(config.Domain + "/")))
+	b.WriteString(sub_content(`<link href="%s"/>`, xml_escape(config.Domain + "/")))
+	b.WriteString(sub_content(`<link href="%s" rel="self"/>`, xml_escape(config.Domain + "/atom.xml")))
+	b.WriteString(sub_content(`<updated>%s</updated>`, updated.Format(time.RFC3339)))
+
+	for _, e := range entries {
+		b.WriteString(`<entry>`)
+		b.WriteString(sub_content(`<title>%s</title>`, xml_escape(e.Title)))
+		b.WriteString(sub_content(`<id>%s</id>`, xml_escape(e.URL)))
+		b.WriteString(sub_content(`<link href="%s"/>`, xml_escape(e.URL)))
+		b.WriteString(sub_content(`<updated>%s</updated>`, e.Date.Format(time.RFC3339)))
+
+		if e.Summary != "" {
+			b.WriteString(sub_content(`<summary>%s</summary>`, xml_escape(e.Summary)))
+		}
+
+		b.WriteString(sub_content(`<content type="html">%s</content>`, xml_escape(e.Content)))
+		b.WriteString(`</entry>`)
+	}
+
+	b.WriteString(`</feed>`)
+
+	return b.String()
+}
+
+type json_feed_item struct {
+	ID            string `json:"id"`
+	URL           string `json:"url"`
+	Title         string `json:"title"`
+	Summary       string `json:"summary,omitempty"`
+	ContentHTML   string `json:"content_html"`
+	DatePublished string `json:"date_published"`
+}
+
+type json_feed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	Description string           `json:"description,omitempty"`
+	HomePageURL string           `json:"home_page_url"`
+	FeedURL     string           `json:"feed_url"`
+	Items       []json_feed_item `json:"items"`
+}
+
+func json_feed_text(entries []*Feed_Entry) string {
+	feed := json_feed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       feed_title(),
+		Description: feed_description(),
+		HomePageURL: config.Domain + "/",
+		FeedURL:     config.Domain + "/feed.json",
+		Items:       make([]json_feed_item, 0, len(entries)),
+	}
+
+	for _, e := range entries {
+		feed.Items = append(feed.Items, json_feed_item{
+			ID:            e.URL,
+			URL:           e.URL,
+			Title:         e.Title,
+			Summary:       e.Summary,
+			ContentHTML:   e.Content,
+			DatePublished: e.Date.Format(time.RFC3339),
+		})
+	}
+
+	b, err := json.Marshal(feed)
+
+	if err != nil {
+		file_error("feed.json", err.Error())
+		return ""
+	}
+
+	return string(b)
+}
+
+func feeds(source map[string]*File_Info) {
+	entries := feed_entries(source)
+
+	var updated time.Time
+
+	for _, e := range entries {
+		if e.Date.After(updated) {
+			updated = e.Date
+		}
+	}
+
+	write_file(filepath.Join(config.Output, `feed.xml`),  rss_feed(entries, updated))
+	write_file(filepath.Join(config.Output, `atom.xml`),  atom_feed(entries, updated))
+	write_file(filepath.Join(config.Output, `feed.json`), json_feed_text(entries))
+}
\ No newline at end of file
@@ -15,6 +15,7 @@ const (
 	ANY File_Format = iota
 	OKO
 	HTML
+	REDIRECT // an alias, see alias_pages
 )
 
 type File_Info struct {
@@ -22,6 +23,10 @@ type File_Info struct {
 	Path string
 	Dir  string
 
+	// the ID of the output when a permalink
+	// puts it somewhere other than ID
+	Target string
+
 	Exclude bool
 
 	Format File_Format
@@ -130,15 +135,35 @@ func walk(root string, extensions ...string) (map[string]*File_Info, time.Time)
 	return list, youngest
 }
 
-func compare_files(source, output map[string]*File_Info) (map[string]*File_Info, map[string]*File_Info) {
+func target(f *File_Info) string {
+	if f.Target != "" {
+		return f.Target
+	}
+	return f.ID
+}
+
+func target_dir(f *File_Info) string {
+	if f.Target != "" {
+		return filepath.Dir(filepath.FromSlash(f.Target))
+	}
+	return f.Dir
+}
+
+// changed decides whether a source with an
+// existing output needs writing again
+func compare_files(source, output map[string]*File_Info, changed func(src, dst *File_Info) bool) (map[string]*File_Info, map[string]*File_Info) {
 	cap := len(source)
 
 	mod := make(map[string]*File_Info, cap)
 	del := make(map[string]*File_Info, cap)
 
+	targets := make(map[string]*File_Info, cap)
+
 	for _, src := range source {
-		if dst, ok := output[src.ID]; ok {
-			if src.Mod.After(dst.Mod) {
+		targets[target(src)] = src
+
+		if dst, ok := output[target(src)]; ok {
+			if changed(src, dst) {
 				mod[src.ID] = src
 			}
 		} else {
@@ -146,8 +171,10 @@ func compare_files(source, output map[string]*File_Info) (map[string]*File_Info,
 		}
 	}
 
+	// an output nothing points at any more, a
+	// deleted page or one that moved, goes
 	for _, src := range output {
-		if f, ok := source[src.ID]; !ok {
+		if f, ok := targets[src.ID]; !ok {
 			del[src.ID] = src
 		} else if f.Exclude {
 			del[src.ID] = src
@@ -163,9 +190,16 @@ func compare_dirs(source, output, file_mod, file_del map[string]*File_Info) (map
 	source_dirs := make(map[string]bool, cap)
 	output_dirs := make(map[string]bool, cap)
 
+	// a directory holding only directories is
+	// still in use; excluded sources, like the
+	// template of generated pages, write nothing
+	// and need no directory
 	for _, f := range source {
-		if f.Dir == "." { continue }
-		source_dirs[f.Dir] = true
+		if f.Exclude { continue }
+
+		for dir := target_dir(f); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+			source_dirs[dir] = true
+		}
 	}
 	for _, f := range output {
 		if f.Dir == "." { continue }
@@ -176,9 +210,9 @@ func compare_dirs(source, output, file_mod, file_del map[string]*File_Info) (map
 	del := make(map[string]bool, cap)
 
 	for _, f := range source {
-		if f.Dir == "." { continue }
-		if !output_dirs[f.Dir] {
-			mod[f.Dir] = true
+		if f.Exclude || target_dir(f) == "." { continue }
+		if !output_dirs[target_dir(f)] {
+			mod[target_dir(f)] = true
 		}
 	}
 	for _, f := range output {
@@ -197,9 +231,13 @@ const (
 	S_PLATES Support_File = iota
 	S_SNIPPETS
 	S_FUNCTIONS
+	S_DATA
 )
 
-func support_files(file_type Support_File, age time.Time) []string {
+// the names of the support files whose
+// content changed since the last build,
+// including ones that were deleted
+func support_files(file_type Support_File) []string {
 	root := ""
 	pref := ""
 
@@ -215,12 +253,16 @@ func support_files(file_type Support_File, age time.Time) []string {
 		case S_FUNCTIONS:
 			root = "_data/functions"
 			pref = "func_"
+
+		case S_DATA:
+			root = data_root
+			pref = "data_"
 	}
 
 	var list []string
 
 	if !path_exists(root) {
-		return list
+		return append(list, support_removed(pref)...)
 	}
 
 	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
@@ -231,15 +273,22 @@ func support_files(file_type Support_File, age time.Time) []string {
 			return nil
 		}
 
-		if info.ModTime().After(age) {
+		if file_type == S_DATA {
+			// data files are named by their path
+			rel, _ := filepath.Rel(root, path)
+			name = pref + data_name(rel)
+		} else {
 			name = pref + name[0:len(name) - len(filepath.Ext(name))]
+		}
+
+		if support_changed(name, path) {
 			list = append(list, name)
 		}
 
 		return nil
 	})
 
-	return list
+	return append(list, support_removed(pref)...)
 }
 
 //
@@ -248,7 +297,7 @@ func support_files(file_type Support_File, age time.Time) []string {
 func path_exists(path string) bool {
 	stat, err := os.Stat(path)
 
-	if os.IsNotExist(err) {
+	if err != nil {
 		return false
 	}
 
@@ -258,7 +307,7 @@ func path_exists(path string) bool {
 func file_exists(path string) bool {
 	stat, err := os.Stat(path)
 
-	if os.IsNotExist(err) {
+	if err != nil {
 		return false
 	}
 
@@ -283,7 +332,8 @@ func copy_file(src, dst string) {
 	source, err := os.Open(src)
 
 	if err != nil {
-		panic(err)
+		file_error(src, err.Error())
+		return
 	}
 
 	defer source.Close()
@@ -291,7 +341,8 @@ func copy_file(src, dst string) {
 	destination, err := os.Create(dst)
 
 	if err != nil {
-		panic(err)
+		file_error(src, err.Error())
+		return
 	}
 
 	defer destination.Close()
@@ -299,7 +350,15 @@ func copy_file(src, dst string) {
 	_, err = io.Copy(destination, source)
 
 	if err != nil {
-		panic(err)
+		file_error(src, err.Error())
+	}
+}
+
+func write_file(path string, content string) {
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+
+	if err != nil {
+		file_error(path, err.Error())
 	}
 }
 
@@ -307,7 +366,21 @@ func delete_file(path string) {
 	err := os.RemoveAll(path)
 
 	if err != nil {
-		panic(err)
+		file_error(path, err.Error())
+	}
+}
+
+// removes the directories above path that
+// are left empty, stopping at root
+func prune_dirs(root, path string) {
+	for dir := filepath.Dir(path); dir != root && dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		list, err := ioutil.ReadDir(dir)
+
+		if err != nil || len(list) > 0 {
+			return
+		}
+
+		delete_file(dir)
 	}
 }
 
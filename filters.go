@@ -0,0 +1,373 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"path/filepath"
+	"github.com/robertkrimen/otto"
+)
+
+// ${title|upper}, ${description|truncate:140}
+// and ${name|default:"Untitled"}; filters run
+// left to right, each one seeing the text the
+// last one produced
+type Filter func(v *Value, args []string) string
+
+var Filters = map[string]Filter {
+	"upper":     filter_upper,
+	"lower":     filter_lower,
+	"truncate":  filter_truncate,
+	"striptags": filter_striptags,
+	"absolute":  filter_absolute,
+	"escape":    filter_escape,
+	"default":   filter_default,
+	"join":      filter_join,
+	"date":      filter_date,
+	"raw":       filter_raw,
+}
+
+type Filter_Call struct {
+	Name string
+	Args []string
+	Text string // the filter as written, for formats
+}
+
+func filter_arg(args []string, n int) (string, bool) {
+	if n < len(args) {
+		return args[n], true
+	}
+	return "", false
+}
+
+func filter_upper(v *Value, args []string) string {
+	return strings.ToUpper(v.Text)
+}
+
+func filter_lower(v *Value, args []string) string {
+	return strings.ToLower(v.Text)
+}
+
+// truncate:140 cuts the text to 140 runes and
+// adds an ellipsis, truncate:140,"..." picks a
+// different one
+func filter_truncate(v *Value, args []string) string {
+	a, _ := filter_arg(args, 0)
+	n, err := strconv.Atoi(a)
+
+	if err != nil || n < 0 {
+		return v.Text
+	}
+
+	runes := []rune(v.Text)
+
+	if len(runes) <= n {
+		return v.Text
+	}
+
+	suffix, ok := filter_arg(args, 1)
+
+	if !ok {
+		suffix = "…"
+	}
+
+	return strings.TrimRightFunc(string(runes[:n]), unicode.IsSpace) + suffix
+}
+
+var tag_pattern = regexp.MustCompile(`<[^>]*>`)
+
+func filter_striptags(v *Value, args []string) string {
+	return tag_pattern.ReplaceAllString(v.Text, "")
+}
+
+// root-relative and bare paths are joined to
+// the domain, anything with a scheme is left
+func filter_absolute(v *Value, args []string) string {
+	text := strings.TrimSpace(v.Text)
+
+	switch {
+		case text == "":
+			return text
+		case strings.Contains(text, "://"), strings.HasPrefix(text, "//"):
+			return text
+		case strings.HasPrefix(text, "#"), strings.HasPrefix(text, "mailto:"), strings.HasPrefix(text, "tel:"):
+			return text
+		case strings.HasPrefix(text, "/"):
+			return config.Domain + text
+	}
+
+	return check_slash(config.Domain) + text
+}
+
+func filter_escape(v *Value, args []string) string {
+	return html.EscapeString(v.Text)
+}
+
+func filter_default(v *Value, args []string) string {
+	if strings.TrimSpace(v.Text) == "" {
+		a, _ := filter_arg(args, 0)
+		return a
+	}
+	return v.Text
+}
+
+func filter_join(v *Value, args []string) string {
+	sep, _ := filter_arg(args, 0)
+
+	if v.Type == V_LIST {
+		return strings.Join(v.List, sep)
+	}
+	return strings.Join(split_list(list_text(v.Text)), sep)
+}
+
+func filter_date(v *Value, args []string) string {
+	format, ok := filter_arg(args, 0)
+
+	if !ok {
+		return v.Text
+	}
+	return format_value(v, format)
+}
+
+// leaves the value unescaped, see mapmap
+func filter_raw(v *Value, args []string) string {
+	return v.Text
+}
+
+func has_raw_filter(calls []*Filter_Call) bool {
+	for _, c := range calls {
+		if c.Name == "raw" {
+			return true
+		}
+	}
+	return false
+}
+
+// splits on sep everywhere outside of quotes
+func split_quoted(s string, sep rune) []string {
+	var list []string
+	var quote rune
+
+	start := 0
+
+	for i, r := range s {
+		switch {
+			case quote != 0:
+				if r == quote {
+					quote = 0
+				}
+			case r == '"' || r == '\'':
+				quote = r
+			case r == sep:
+				list = append(list, s[start:i])
+				start = i + 1
+		}
+	}
+
+	return append(list, s[start:])
+}
+
+func unquote_arg(a string) string {
+	a = strings.TrimSpace(a)
+
+	if len(a) > 1 && (a[0] == '"' || a[0] == '\'') && a[len(a)-1] == a[0] {
+		return a[1:len(a)-1]
+	}
+	return a
+}
+
+func is_filter_name(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// "tags|join:', '|upper" -> "tags", [join upper]
+func parse_filters(id string) (string, []*Filter_Call) {
+	parts := split_quoted(id, '|')
+	name  := strings.TrimSpace(parts[0])
+
+	calls := make([]*Filter_Call, 0, len(parts) - 1)
+
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		call := &Filter_Call{Name: part, Text: part}
+
+		if n := strings.IndexRune(part, ':'); n >= 0 && is_filter_name(part[:n]) {
+			call.Name = part[:n]
+
+			for _, a := range split_quoted(part[n+1:], ',') {
+				call.Args = append(call.Args, unquote_arg(a))
+			}
+		}
+
+		calls = append(calls, call)
+	}
+
+	return name, calls
+}
+
+func apply_filters(key, text string, calls []*Filter_Call) string {
+	v := parse_value(key, text)
+
+	for _, c := range calls {
+		if f, ok := Filters[c.Name]; ok {
+			text = f(v, c.Args)
+		} else if out, ok := js_filter(c.Name, v, c.Args); ok {
+			text = out
+		} else if is_format(c.Name) {
+			// not a filter, so a date or number format
+			text = format_value(v, c.Text)
+		} else {
+			unknown_filter(key, c.Name)
+		}
+
+		v = parse_value("", text)
+	}
+
+	return text
+}
+
+// date layouts and number formats always
+// have a digit or something a filter name
+// can't hold, like "2006-01-02", "Jan 2" or
+// "%.2f", so a plain word is a filter that
+// doesn't exist, not a format
+func is_format(name string) bool {
+	return !is_filter_name(name) || strings.ContainsAny(name, "0123456789")
+}
+
+// each unknown filter is reported once, not
+// once for every page using the plate it's in
+func unknown_filter(key, name string) {
+	msg := `unknown filter "` + name + `" on ${` + key + `}`
+
+	diagnostic_mutex.Lock()
+
+	for _, d := range Diagnostics {
+		if d.Message == msg {
+			diagnostic_mutex.Unlock()
+			return
+		}
+	}
+
+	diagnostic_mutex.Unlock()
+
+	warning(msg)
+}
+
+// filters that aren't built in are looked up
+// in _data/functions: <name>.js reads value
+// and args and sets result, like any other
+// function
+func js_filter(name string, v *Value, args []string) (string, bool) {
+	if !is_filter_name(name) {
+		return "", false
+	}
+
+	path := filepath.Join("_data/functions", name + ".js")
+
+	if !file_exists(path) {
+		return "", false
+	}
+
+	script := load_script(path)
+
+	if script.Err != nil {
+		file_error(path, `filter "` + name + `" failed: ` + script_error(script.Err))
+		return v.Text, true
+	}
+
+	vm := otto.New()
+
+	js_args, _ := vm.Object(`[]`)
+
+	for _, a := range args {
+		js_args.Call("push", a)
+	}
+
+	vm.Set("value",   js_value(vm, v))
+	vm.Set("args",    js_args)
+	vm.Set("project", js_copy(config))
+	vm.Set("data",    js_data(script.Source))
+
+	// no read_file or list_files here: filters
+	// run while rendering, where nothing could
+	// rebuild the page when the file changed
+
+	err := run_script(vm, script)
+
+	if err != nil {
+		file_error(path, `filter "` + name + `" failed: ` + script_error(err))
+		return v.Text, true
+	}
+
+	result, err := vm.Get("result")
+
+	if err != nil || result.IsUndefined() || result.IsNull() {
+		return "", true
+	}
+
+	return result.String(), true
+}
+
+// pages depend on the javascript filters and
+// data files their variables use, so editing
+// either rebuilds them
+func variable_dependencies(page *Page, list []*Token) {
+	seen := make(map[string]bool)
+
+	add := func(text string) {
+		for {
+			pos := strings.Index(text, "${")
+
+			if pos < 0 {
+				return
+			}
+
+			end := strings.IndexRune(text[pos:], '}')
+
+			if end < 0 {
+				return
+			}
+
+			id, calls := parse_filters(text[pos+2:pos+end])
+			text = text[pos+end:]
+
+			if strings.HasPrefix(id, "data.") {
+				data_dependency(page, id[5:])
+			}
+
+			for _, c := range calls {
+				if _, ok := Filters[c.Name]; ok || seen[c.Name] || !is_filter_name(c.Name) {
+					continue
+				}
+
+				seen[c.Name] = true
+
+				name := "func_" + c.Name
+				add_dependency(name, page.ID)
+			}
+		}
+	}
+
+	for _, tok := range list {
+		if tok.Type != CODE_GUTS {
+			add(tok.Text)
+		}
+	}
+
+	if name, ok := page.Vars["plate"]; ok {
+		for _, t := range load_plate(name).Tokens {
+			add(t)
+		}
+	}
+}
\ No newline at end of file
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+	"strconv"
+	"strings"
+	"unicode"
+	"path/filepath"
+)
+
+// adds a page that has no source file of its
+// own to PageList and to the source listing,
+// so compare_files renders it and never sees
+// its output as an orphan
+func add_generated_page(source map[string]*File_Info, id, path, origin string, mod time.Time) *Page {
+	info := &File_Info{
+		ID:     id,
+		Path:   path,
+		Dir:    filepath.Dir(filepath.FromSlash(id)),
+		Format: OKO,
+		Mod:    mod,
+	}
+
+	source[id] = info
+
+	the_page := make_page(info)
+	the_page.Origin = origin
+
+	return the_page
+}
+
+// the ID and URL of the nth page of a listing,
+// "blog/index" continues as "blog/page/2"
+func page_number_id(origin *Page, n int) string {
+	base := strings.TrimSuffix(output_id(origin), "/index")
+
+	if base == "index" {
+		return "page/" + strconv.Itoa(n)
+	}
+	return base + "/page/" + strconv.Itoa(n)
+}
+
+func page_number_url(origin *Page, n int) string {
+	if n == 1 {
+		if origin.URLPath == "" {
+			return "/"
+		}
+		return origin.URLPath
+	}
+	return url_path(page_number_id(origin, n))
+}
+
+// a page whose each block has paginate=n is
+// rendered as several pages, each carrying
+// page_number, total_pages, next_url and
+// prev_url for its plate
+func paginate_pages(source map[string]*File_Info) {
+	origins := make([]*Page, 0, 8)
+
+	for _, page := range PageList {
+		if page.Origin == "" {
+			origins = append(origins, page)
+		}
+	}
+
+	for _, page := range origins {
+		if page.IsDraft && !config.ShowDrafts {
+			continue
+		}
+
+		var args *Each_Args
+
+		for _, tok := range page.List.Tokens {
+			if tok.Type != BLOCK_EACH {
+				continue
+			}
+			if a, err := parse_each(tok.Text); err == nil && a.Paginate > 0 {
+				args = a
+				break
+			}
+		}
+
+		if args == nil {
+			continue
+		}
+
+		// count every match, not just the first page
+		all_args := *args
+		all_args.Paginate = 0
+
+		count := len(each_pages(page, &all_args))
+		total := (count + args.Paginate - 1) / args.Paginate
+
+		if total < 1 {
+			total = 1
+		}
+
+		series := []*Page{page}
+
+		var mod time.Time
+
+		if f, ok := source[page.ID]; ok {
+			mod = f.Mod
+		}
+
+		for n := 2; n <= total; n++ {
+			the_page := add_generated_page(source, page_number_id(page, n), page.SourcePath, page.ID, mod)
+			the_page.List = parser(the_page, load_file_bytes(page.SourcePath))
+
+			do_functions(the_page)
+
+			series = append(series, the_page)
+		}
+
+		for i, the_page := range series {
+			n := i + 1
+
+			the_page.Vars["page_number"] = strconv.Itoa(n)
+			the_page.Vars["total_pages"] = strconv.Itoa(total)
+			the_page.Vars["prev_url"]    = ""
+			the_page.Vars["next_url"]    = ""
+
+			if n > 1 {
+				the_page.Vars["prev_url"] = page_number_url(page, n-1)
+			}
+			if n < total {
+				the_page.Vars["next_url"] = page_number_url(page, n+1)
+			}
+		}
+	}
+}
+
+// generate: data/products.json key=slug path=/products/${slug}
+//
+// renders the page once for every record of a
+// data file, with the record's fields as page
+// variables; without a path the pages go next
+// to the template, named by the key field
+type Generate_Args struct {
+	Data string
+	Key  string
+	Path string
+}
+
+func parse_generate(text string) (*Generate_Args, error) {
+	fields := strings.Fields(text)
+
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("generate is missing a data file")
+	}
+
+	args := &Generate_Args{}
+
+	ref := strings.TrimPrefix(filepath.ToSlash(fields[0]), "_data/")
+
+	switch {
+		case strings.HasPrefix(ref, "data/"):
+			args.Data = data_name(ref[5:])
+		case strings.HasPrefix(ref, "data."):
+			args.Data = ref[5:]
+		default:
+			return nil, fmt.Errorf("generate needs a file in %s, not %q", data_root, fields[0])
+	}
+
+	for _, f := range fields[1:] {
+		switch {
+			case strings.HasPrefix(f, "key="):
+				args.Key = f[4:]
+
+			case strings.HasPrefix(f, "path="):
+				args.Path = f[5:]
+
+			default:
+				return nil, fmt.Errorf("unknown argument %q in generate", f)
+		}
+	}
+
+	if args.Key == "" && args.Path == "" {
+		return nil, fmt.Errorf("generate needs key= or path=")
+	}
+
+	return args, nil
+}
+
+// the ID of a record's page, "/products/${slug}"
+// -> "products/widget"; every variable in the
+// pattern must have a value and none of them
+// can add directories
+func record_page_id(pattern string, vars map[string]string) (string, error) {
+	var id strings.Builder
+
+	for {
+		pos := strings.Index(pattern, "${")
+
+		if pos < 0 {
+			break
+		}
+
+		end := strings.IndexRune(pattern[pos:], '}')
+
+		if end < 0 {
+			return "", fmt.Errorf("unclosed variable in generate path %s", pattern)
+		}
+
+		key   := pattern[pos+2:pos+end]
+		value := record_slug(vars[key])
+
+		if strings.Contains(vars[key], "..") {
+			return "", fmt.Errorf("a record's %s %q leaves the output directory", key, vars[key])
+		}
+
+		if value == "" {
+			return "", fmt.Errorf("a record has no %s for its path", key)
+		}
+
+		id.WriteString(pattern[:pos])
+		id.WriteString(value)
+
+		pattern = pattern[pos+end+1:]
+	}
+
+	id.WriteString(pattern)
+
+	result := strings.TrimPrefix(id.String(), "/")
+
+	if strings.Contains(result, "..") {
+		return "", fmt.Errorf("generated page %s leaves the output directory", result)
+	}
+
+	if result == "" || strings.HasSuffix(result, "/") {
+		result += "index"
+	}
+
+	return result, nil
+}
+
+// a record value made safe for one part of a
+// path: spaces become dashes, separators and
+// anything else odd are dropped
+func record_slug(v string) string {
+	var slug strings.Builder
+
+	for _, c := range strings.TrimSpace(v) {
+		switch {
+			case unicode.IsLetter(c) || unicode.IsNumber(c) || c == '-' || c == '_' || c == '.':
+				slug.WriteRune(c)
+			case unicode.IsSpace(c):
+				slug.WriteRune('-')
+		}
+	}
+
+	return slug.String()
+}
+
+// record pages are ordinary pages without a
+// source file; they list, paginate and tag like
+// any other, and the template itself is never
+// written
+func record_pages(source map[string]*File_Info) {
+	templates := make([]*Page, 0, 8)
+
+	for _, page := range PageList {
+		if _, ok := page.Vars["generate"]; ok && page.Origin == "" {
+			templates = append(templates, page)
+		}
+	}
+
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].ID < templates[j].ID
+	})
+
+	for _, page := range templates {
+		template := source[page.ID]
+
+		// the template only exists to be copied
+		template.Exclude = true
+		delete(PageList, page.ID)
+
+		if page.IsDraft && !config.ShowDrafts {
+			continue
+		}
+
+		args, err := parse_generate(page.Vars["generate"])
+
+		if err != nil {
+			file_error(page.SourcePath, err.Error())
+			continue
+		}
+
+		data_dependency(page, args.Data)
+
+		records := data_pages(args.Data)
+
+		if records == nil {
+			file_error(page.SourcePath, "no data file " + args.Data + " to generate from")
+			continue
+		}
+
+		pattern := args.Path
+
+		if pattern == "" {
+			dir := filepath.ToSlash(filepath.Dir(page.ID))
+
+			if dir == "." {
+				dir = ""
+			}
+
+			pattern = dir + "/${" + args.Key + "}"
+		}
+
+		mod := template.Mod
+
+		if info, ok := file_data(data_path(args.Data)); ok && info.ModTime().After(mod) {
+			mod = info.ModTime()
+		}
+
+		for _, record := range records {
+			if args.Key != "" && record.Vars[args.Key] == "" {
+				file_error(page.SourcePath, "a record in " + args.Data + " has no " + args.Key)
+				continue
+			}
+
+			id, err := record_page_id(pattern, record.Vars)
+
+			if err != nil {
+				file_error(page.SourcePath, err.Error())
+				continue
+			}
+
+			if _, ok := source[id]; ok {
+				file_error(page.SourcePath, "generated page " + id + " already exists")
+				continue
+			}
+
+			the_page := add_generated_page(source, id, page.SourcePath, "", mod)
+			the_page.List = parser(the_page, load_file_bytes(page.SourcePath))
+
+			delete(the_page.Vars, "generate")
+
+			for k, v := range record.Vars {
+				the_page.Typed[k] = parse_value(k, v)
+				the_page.Vars[k]  = the_page.Typed[k].Text
+			}
+
+			do_functions(the_page)
+			data_dependency(the_page, args.Data)
+
+			// the template stands in for its pages
+			add_dependency(page.ID, id)
+		}
+	}
+}
+
+// taxonomy pages to refresh when a page
+// was deleted
+func taxonomy_dependents() []string {
+	var list []string
+
+	for key, ids := range DepTree {
+		if strings.HasPrefix(key, "taxonomy_") {
+			list = append(list, ids...)
+		}
+	}
+
+	return list
+}
+
+// every term of a taxonomy gets a page made
+// of imports of the pages using it, rendered
+// with the taxonomy's plate, and the index
+// imports each term page
+func taxonomy_pages(source map[string]*File_Info) {
+	names := make([]string, 0, len(config.Taxonomies))
+
+	for name := range config.Taxonomies {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		tax    := config.Taxonomies[name]
+		origin := "taxonomy_" + name
+
+		if tax.Plate == "" {
+			file_error("_data/oko.json", "taxonomy " + name + " has no plate")
+			continue
+		}
+
+		terms := make(map[string][]*Page)
+		slugs := make(map[string]string)
+
+		var pages []*Page
+		var mod   time.Time
+
+		for _, page := range PageList {
+			if page.Origin != "" || (page.IsDraft && !config.ShowDrafts) {
+				continue
+			}
+
+			pages = append(pages, page)
+
+			for _, term := range split_list(page.Vars[name]) {
+				slug := make_element_id(term)
+
+				if _, ok := slugs[slug]; !ok {
+					slugs[slug] = term
+				}
+
+				terms[slug] = append(terms[slug], page)
+			}
+
+			if f, ok := source[page.ID]; ok && f.Mod.After(mod) {
+				mod = f.Mod
+			}
+		}
+
+		if len(terms) == 0 {
+			continue
+		}
+
+		index_id := tax.Path + "/index"
+
+		if _, ok := source[index_id]; ok {
+			warning("taxonomy " + name + " would overwrite " + index_id)
+			continue
+		}
+
+		var generated []string
+
+		order := make([]string, 0, len(terms))
+
+		for slug := range terms {
+			order = append(order, slug)
+		}
+
+		sort.Strings(order)
+
+		index := add_generated_page(source, index_id, plate_path(tax.IndexPlate), origin, mod)
+		index.Vars["title"]    = name
+		index.Vars["plate"]    = tax.IndexPlate
+		index.Vars["taxonomy"] = name
+
+		var index_tokens []*Token
+
+		for _, slug := range order {
+			id := tax.Path + "/" + slug
+
+			if _, ok := source[id]; ok {
+				warning("taxonomy " + name + " would overwrite " + id)
+				continue
+			}
+
+			list := terms[slug]
+
+			sort.SliceStable(list, func(i, j int) bool {
+				c := compare_vars(list[i].Vars["date"], list[j].Vars["date"])
+
+				if c == 0 {
+					return list[i].ID < list[j].ID
+				}
+				return c > 0
+			})
+
+			the_page := add_generated_page(source, id, plate_path(tax.Plate), origin, mod)
+			the_page.Vars["title"]    = slugs[slug]
+			the_page.Vars["term"]     = slugs[slug]
+			the_page.Vars["plate"]    = tax.Plate
+			the_page.Vars["taxonomy"] = name
+			the_page.Vars["count"]    = strconv.Itoa(len(list))
+
+			var tokens []*Token
+
+			for _, p := range list {
+				tokens = append(tokens, &Token{IMPORT, 0, p.ID, 0, nil, nil})
+			}
+
+			the_page.List = &Token_List{Tokens: tokens}
+
+			index_tokens = append(index_tokens, &Token{IMPORT, 0, id, 0, nil, nil})
+			generated    = append(generated, id)
+		}
+
+		index.List = &Token_List{Tokens: index_tokens}
+		generated  = append(generated, index_id)
+
+		// a page that drops a term isn't listed
+		// under it any more, so the term page it
+		// left can't be found from this build
+		// alone; every page feeds every term page
+		for _, page := range pages {
+			add_dependency(page.ID, generated...)
+		}
+
+		for _, plate := range []string{tax.Plate, tax.IndexPlate} {
+			n := "plate_" + plate
+			add_dependency(n, generated...)
+		}
+
+		DepTree[origin] = generated
+	}
+}
\ No newline at end of file
@@ -1,36 +1,80 @@
 package main
 
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// the text of a project setting as seen by
+// an if-statement; individual entries of
+// the meta and vars maps are addressed as
+// meta.key and vars.key
+func project_value(name string) (string, bool) {
+	switch name {
+		case "domain":  return config.Domain,  config.Domain  != ""
+		case "output":  return config.Output,  config.Output  != ""
+		case "favicon": return config.Favicon, config.Favicon != ""
+		case "title":   return config.Title,   config.Title   != ""
+	}
+
+	n := strings.SplitN(name, ".", 2)
+
+	if len(n) == 2 {
+		switch n[0] {
+			case "meta":
+				v, ok := config.Meta[n[1]]
+				return v, ok
+
+			case "vars":
+				v, ok := config.Vars[n[1]]
+				return v, ok
+		}
+	}
+
+	return "", false
+}
+
+// the text of a page variable, meta.* keys
+// are read from Page.Meta
+func page_value(the_page *Page, name string) string {
+	if the_page == nil {
+		return ""
+	}
+
+	if strings.HasPrefix(name, "meta.") {
+		if v, ok := the_page.Meta[name[5:]]; ok {
+			return v
+		}
+	}
+
+	return the_page.Vars[name]
+}
+
 func if_project_value(tok *Token) bool {
 	switch tok.Text {
-		case "domain":
-			if config.Domain != "" {
-				return true
-			}
-		case "output":
-			if config.Output != "" {
-				return true
-			}
-		case "favicon":
-			if config.Favicon != "" {
-				return true
-			}
 		case "style":
-			if len(config.Style) > 0 {
-				return true
-			}
+			return len(config.Style) > 0
 		case "include":
-			if len(config.Include) > 0 {
-				return true
-			}
+			return len(config.Include) > 0
 		case "meta":
-			if len(config.Meta) > 0 {
-				return true
-			}
+			return len(config.Meta) > 0
+		case "vars":
+			return len(config.Vars) > 0
 	}
+
+	if v, ok := project_value(tok.Text); ok {
+		return v != "" && v != "false"
+	}
+
 	return false
 }
 
 func if_page_value(the_page *Page, tok *Token) bool {
+	if the_page == nil {
+		return false
+	}
+
 	switch tok.Text {
 		case "style":
 			if len(the_page.Style) > 0 {
@@ -51,14 +95,389 @@ func if_page_value(the_page *Page, tok *Token) bool {
 	return false
 }
 
+// inside an each block, page is the page
+// the block is repeating for
+func each_page(the_page *Page) *Page {
+	if the_page.EachItem != nil {
+		return the_page.EachItem
+	}
+	return the_page
+}
+
 func check_if_statement(the_page *Page, tok *Token) bool {
 	switch tok.Type {
 		case IF_SCOPE_PROJECT:     return if_project_value(tok)
 		case IF_SCOPE_PROJECT_NOT: return !if_project_value(tok)
-		case IF_SCOPE_PAGE:        return if_page_value(the_page, tok)
-		case IF_SCOPE_PAGE_NOT:    return !if_page_value(the_page, tok)
+		case IF_SCOPE_PAGE:        return if_page_value(each_page(the_page), tok)
+		case IF_SCOPE_PAGE_NOT:    return !if_page_value(each_page(the_page), tok)
 		case IF_SCOPE_PARENT:      return if_page_value(the_page.CurrentParent, tok)
 		case IF_SCOPE_PARENT_NOT:  return !if_page_value(the_page.CurrentParent, tok)
+
+		case IF_EXPRESSION:
+			if tok.cond != nil {
+				return eval_condition(the_page, tok.cond)
+			}
 	}
 	return false
-}
\ No newline at end of file
+}
+
+//
+// Expressions
+//
+// conditions such as
+//
+//   if page.layout == "wide" && !parent.hide {
+//
+// are parsed into a small tree and evaluated
+// against Page.Vars, Page.Meta and the config
+type If_Node struct {
+	Op    string // "||", "&&", "!", a comparison, or "" for a value
+	Left  *If_Node
+	Right *If_Node
+
+	Scope string // page, parent or project - empty for literals
+	Name  string // variable name or literal value
+}
+
+var if_comparisons = map[string]bool {
+	"==": true, "!=": true,
+	"<":  true, ">":  true,
+	"<=": true, ">=": true,
+	"contains": true,
+}
+
+func lex_condition(cond string) ([]string, error) {
+	var list []string
+
+	input := []rune(cond)
+
+	for len(input) > 0 {
+		r := input[0]
+
+		if unicode.IsSpace(r) {
+			input = input[1:]
+			continue
+		}
+
+		// quoted strings keep their quotes so the
+		// parser can tell them from variables
+		if r == '"' || r == '\'' {
+			end := 1
+
+			for end < len(input) && input[end] != r {
+				end++
+			}
+
+			if end == len(input) {
+				return nil, fmt.Errorf("unterminated string in if-statement")
+			}
+
+			list  = append(list, string(input[:end+1]))
+			input = input[end+1:]
+			continue
+		}
+
+		if len(input) > 1 {
+			pair := string(input[:2])
+
+			switch pair {
+				case "==", "!=", "&&", "||", "<=", ">=":
+					list  = append(list, pair)
+					input = input[2:]
+					continue
+			}
+		}
+
+		switch r {
+			case '!', '(', ')', '<', '>':
+				list  = append(list, string(r))
+				input = input[1:]
+				continue
+		}
+
+		c := 0
+
+		for c < len(input) {
+			r := input[c]
+
+			if !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '-') {
+				break
+			}
+			c++
+		}
+
+		if c == 0 {
+			return nil, fmt.Errorf("unexpected %q in if-statement", string(r))
+		}
+
+		list  = append(list, string(input[:c]))
+		input = input[c:]
+	}
+
+	return list, nil
+}
+
+func parse_condition(cond string) (*If_Node, error) {
+	list, err := lex_condition(cond)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no condition in if-statement")
+	}
+
+	pos := 0
+
+	peek := func() string {
+		if pos < len(list) {
+			return list[pos]
+		}
+		return ""
+	}
+
+	var parse_or func() (*If_Node, error)
+
+	parse_value := func() (*If_Node, error) {
+		t := peek()
+
+		if t == "" {
+			return nil, fmt.Errorf("if-statement ends too early")
+		}
+
+		pos++
+
+		if t[0] == '"' || t[0] == '\'' {
+			return &If_Node{Name: t[1:len(t)-1]}, nil
+		}
+
+		if t[0] == '-' || unicode.IsDigit(rune(t[0])) || t == "true" || t == "false" {
+			return &If_Node{Name: t}, nil
+		}
+
+		n := strings.SplitN(t, ".", 2)
+
+		switch n[0] {
+			case "page", "parent", "project":
+			default:
+				return nil, fmt.Errorf("no such scope %s", n[0])
+		}
+
+		if len(n) == 1 {
+			return nil, fmt.Errorf("missing '.' separator in if-statement")
+		}
+
+		if n[1] == "" {
+			return nil, fmt.Errorf("no variable in if-statement")
+		}
+
+		return &If_Node{Scope: n[0], Name: n[1]}, nil
+	}
+
+	var parse_unary func() (*If_Node, error)
+
+	parse_unary = func() (*If_Node, error) {
+		switch peek() {
+			case "!":
+				pos++
+				child, err := parse_unary()
+
+				if err != nil {
+					return nil, err
+				}
+
+				return &If_Node{Op: "!", Left: child}, nil
+
+			case "(":
+				pos++
+				child, err := parse_or()
+
+				if err != nil {
+					return nil, err
+				}
+
+				if peek() != ")" {
+					return nil, fmt.Errorf("missing ')' in if-statement")
+				}
+
+				pos++
+				return child, nil
+		}
+
+		left, err := parse_value()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if op := peek(); if_comparisons[op] {
+			pos++
+
+			if peek() == "" {
+				return nil, fmt.Errorf("missing value after %s in if-statement", op)
+			}
+
+			right, err := parse_value()
+
+			if err != nil {
+				return nil, err
+			}
+
+			return &If_Node{Op: op, Left: left, Right: right}, nil
+		}
+
+		return left, nil
+	}
+
+	parse_and := func() (*If_Node, error) {
+		left, err := parse_unary()
+
+		for err == nil && peek() == "&&" {
+			pos++
+
+			var right *If_Node
+			right, err = parse_unary()
+			left = &If_Node{Op: "&&", Left: left, Right: right}
+		}
+
+		return left, err
+	}
+
+	parse_or = func() (*If_Node, error) {
+		left, err := parse_and()
+
+		for err == nil && peek() == "||" {
+			pos++
+
+			var right *If_Node
+			right, err = parse_and()
+			left = &If_Node{Op: "||", Left: left, Right: right}
+		}
+
+		return left, err
+	}
+
+	node, err := parse_or()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if pos < len(list) {
+		return nil, fmt.Errorf("unexpected %q in if-statement", list[pos])
+	}
+
+	return node, nil
+}
+
+// reports whether any part of the condition
+// reads from the given scope
+func condition_uses(node *If_Node, scope string) bool {
+	if node == nil {
+		return false
+	}
+	if node.Scope == scope {
+		return true
+	}
+	return condition_uses(node.Left, scope) || condition_uses(node.Right, scope)
+}
+
+// the raw text of a value, used by comparisons
+func condition_value(the_page *Page, node *If_Node) string {
+	switch node.Scope {
+		case "page":
+			return page_value(each_page(the_page), node.Name)
+
+		case "parent":
+			return page_value(the_page.CurrentParent, node.Name)
+
+		case "project":
+			v, _ := project_value(node.Name)
+			return v
+	}
+	return node.Name
+}
+
+// values on their own keep the meaning if
+// statements always had
+func condition_truth(the_page *Page, node *If_Node) bool {
+	tok := &Token{Text: node.Name}
+
+	switch node.Scope {
+		case "page":    return if_page_value(each_page(the_page), tok)
+		case "parent":  return if_page_value(the_page.CurrentParent, tok)
+		case "project": return if_project_value(tok)
+	}
+
+	return node.Name != "" && node.Name != "false" && node.Name != "0"
+}
+
+// the typed value of one side of a
+// comparison, page variables as the page
+// typed them
+func condition_typed(the_page *Page, node *If_Node) *Value {
+	var p *Page
+
+	switch node.Scope {
+		case "page":   p = each_page(the_page)
+		case "parent": p = the_page.CurrentParent
+	}
+
+	if p != nil && !strings.HasPrefix(node.Name, "meta.") {
+		return typed_var(p, node.Name)
+	}
+	return parse_value(node.Name, condition_value(the_page, node))
+}
+
+// lists contain their items, one item or
+// many; anything else contains its substrings
+func condition_contains(a *Value, b string) bool {
+	if a.Type != V_LIST {
+		return strings.Contains(a.Text, b)
+	}
+
+	for _, item := range a.List {
+		if item == b {
+			return true
+		}
+	}
+	return false
+}
+
+func compare_condition(op, a, b string) bool {
+	// dates and numbers compare as what they
+	// are, so 9 < 10 and 2021-03-04 is the
+	// same date as 2021-03-04T00:00:00Z
+	c := compare_vars(a, b)
+
+	switch op {
+		case "==": return c == 0
+		case "!=": return c != 0
+		case "<":  return c < 0
+		case ">":  return c > 0
+		case "<=": return c <= 0
+		case ">=": return c >= 0
+	}
+
+	return false
+}
+
+func eval_condition(the_page *Page, node *If_Node) bool {
+	switch node.Op {
+		case "":   return condition_truth(the_page, node)
+		case "!":  return !eval_condition(the_page, node.Left)
+		case "&&": return eval_condition(the_page, node.Left) && eval_condition(the_page, node.Right)
+		case "||": return eval_condition(the_page, node.Left) || eval_condition(the_page, node.Right)
+	}
+
+	b := condition_value(the_page, node.Right)
+
+	if node.Op == "contains" {
+		return condition_contains(condition_typed(the_page, node.Left), b)
+	}
+
+	a := condition_value(the_page, node.Left)
+
+	return compare_condition(node.Op, a, b)
+}
@@ -4,14 +4,21 @@ import (
 	"os"
 	"fmt"
 	"sort"
+	"sync"
+	"strings"
+	"runtime"
+	"runtime/debug"
 	"path/filepath"
 )
 
 var config *Config
 
 func do_pages() {
-	source, _   := walk(".", config.Extensions...)
-	output, age := walk(config.Output, ".html")
+	load_data()
+	load_manifest()
+
+	source, _ := walk(".", config.Extensions...)
+	output, _ := walk(config.Output, ".html")
 
 	for _, file := range source {
 		if file.Format != OKO {
@@ -23,6 +30,8 @@ func do_pages() {
 
 		the_page.List = parser(the_page, bytes)
 
+		parse_errors(the_page, the_page.List)
+
 		if config.ShowDrafts {
 			continue
 		}
@@ -32,22 +41,47 @@ func do_pages() {
 		}
 	}
 
-	// because it is impossible to determine
-	// what user code is going to do before it
-	// runs, we must run every function every
-	// single time to determine the dependencies
+	// what user code reads can't be known
+	// before it runs, so every function is
+	// visited every time; one whose script and
+	// recorded inputs haven't changed since
+	// the last build reuses its old result
+	//
+	// functions only see other pages as they
+	// were before any of them ran, so they can
+	// all run at once
+	pages := make([]*Page, 0, len(PageList))
+
 	for _, page := range PageList {
-		do_functions(page)
+		pages = append(pages, page)
+	}
+
+	results := make([]*Function_Result, len(pages))
+
+	parallel(len(pages), func(i int) {
+		results[i] = run_functions(pages[i])
+	})
+
+	for i, page := range pages {
+		apply_functions(page, results[i])
 	}
 
-	file_mod, file_del := compare_files(source, output)
+	permalinks(source)
+	record_pages(source)
+	paginate_pages(source)
+	taxonomy_pages(source)
+	alias_pages(source)
+	hash_sources(source)
+
+	file_mod, file_del := compare_files(source, output, page_changed)
 	path_mod, path_del := compare_dirs(source, output, file_mod, file_del)
 
-	plates    := support_files(S_PLATES,    age)
-	snippets  := support_files(S_SNIPPETS,  age)
-	functions := support_files(S_FUNCTIONS, age)
+	plates    := support_files(S_PLATES)
+	snippets  := support_files(S_SNIPPETS)
+	functions := support_files(S_FUNCTIONS)
+	datafiles := support_files(S_DATA)
 
-	if config.DoAllPages {
+	if config.DoAllPages || build_changed() {
 		file_mod  = make(map[string]*File_Info, len(source))
 
 		for _, f := range source {
@@ -55,25 +89,55 @@ func do_pages() {
 		}
 
 	} else {
-		for _, file := range file_mod {
-			if list, ok := DepTree[file.ID]; ok {
-				for _, id := range list {
-					file_mod[id] = source[id]
-				}
+		changed := make([]string, 0, len(file_mod) + len(file_del))
+
+		for id := range file_mod {
+			changed = append(changed, id)
+		}
+		for id := range file_del {
+			changed = append(changed, output_page(id))
+		}
+
+		for _, id := range changed {
+			mark_pages(file_mod, source, dependents(id))
+		}
+
+		for _, list := range [][]string{snippets, plates, functions, datafiles} {
+			for _, name := range list {
+				mark_pages(file_mod, source, dependents(name))
 			}
 		}
-		for _, s := range snippets {
-			for _, id := range DepTree[s] {
-				file_mod[id] = source[id]
+
+		// a function can return something new
+		// while its page stays the same, when a
+		// file it reads changes for instance
+		for id := range FunctionChanged {
+			mark_pages(file_mod, source, []string{id})
+		}
+
+		for _, id := range changed {
+			for _, dep := range each_dependents(id) {
+				if f, ok := source[dep]; ok {
+					file_mod[dep] = f
+				}
 			}
 		}
-		for _, p := range plates {
-			for _, id := range DepTree[p] {
-				file_mod[id] = source[id]
+
+		if len(file_del) > 0 {
+			for _, dep := range taxonomy_dependents() {
+				if f, ok := source[dep]; ok {
+					file_mod[dep] = f
+				}
 			}
 		}
-		for _, p := range functions {
-			for _, id := range DepTree[p] {
+
+		// generated pages follow the page they
+		// were generated from
+		for id, page := range PageList {
+			if page.Origin == "" {
+				continue
+			}
+			if _, ok := file_mod[page.Origin]; ok {
 				file_mod[id] = source[id]
 			}
 		}
@@ -90,13 +154,14 @@ func do_pages() {
 	sitemap_path := filepath.Join(config.Output, `sitemap.xml`)
 
 	if config.Sitemap {
-		if !file_exists(sitemap_path) || len(file_mod) > 0 {
-			sitemap(sitemap_path)
+		if !file_exists(sitemap_path) || len(file_mod) > 0 || len(file_del) > 0 {
+			sitemap(config.Output)
 		}
 	} else {
 		if file_exists(sitemap_path) {
 			delete_file(sitemap_path)
 		}
+		delete_sitemap_parts(config.Output, 1)
 	}
 
 	file_mod_ordered := make([]*File_Info, 0, len(file_mod))
@@ -112,22 +177,38 @@ func do_pages() {
 		return file_mod_ordered[i].ID < file_mod_ordered[j].ID
 	})
 
-	for _, file := range file_mod_ordered {
-		ID := file.ID
+	// pages whose rendered bytes match what is
+	// already there aren't written or reported
+	updated := make([]bool, len(file_mod_ordered))
+
+	parallel(len(file_mod_ordered), func(i int) {
+		file := file_mod_ordered[i]
 
 		if file.Format == HTML {
-			copy_file(file.Path, filepath.Join(config.Output, file.Path))
-			continue
+			out := filepath.Join(config.Output, file.Path)
+
+			if hash_file(out) != hash_file(file.Path) {
+				copy_file(file.Path, out)
+				updated[i] = true
+			}
+
+			record_output(out, file.Path)
+			return
+		}
+
+		if file.Format == REDIRECT {
+			updated[i] = write_redirect(file)
+			return
 		}
 
-		page := PageList[ID]
+		page := PageList[file.ID]
 
 		if page.IsDraft && !config.ShowDrafts {
-			continue
+			return
 		}
 
-		render(page)
-	}
+		updated[i] = render(page)
+	})
 
 	for _, file := range file_del {
 		delete_file(filepath.Join(config.Output, file.Path))
@@ -135,13 +216,47 @@ func do_pages() {
 
 	for path, _ := range path_del {
 		delete_file(filepath.Join(config.Output, path))
+		prune_dirs(config.Output, filepath.Join(config.Output, path))
 	}
 
-	if len(file_mod_ordered) > 0 {
+	// excluded sources used to get a directory
+	// with pretty urls; empty ones left behind
+	// by older builds go
+	for _, f := range source {
+		if f.Exclude {
+			prune_dirs(config.Output, filepath.Join(config.Output, filepath.FromSlash(output_target(target(f))) + ".html"))
+		}
+	}
+
+	redirect_list(source)
+
+	if config.Feed != nil {
+		if feeds_changed(file_mod, file_del) {
+			feeds(source)
+		}
+	} else {
+		for _, f := range feed_files {
+			if p := filepath.Join(config.Output, f); file_exists(p) {
+				delete_file(p)
+			}
+		}
+	}
+
+	save_manifest()
+
+	report_list := make([]string, 0, len(file_mod_ordered))
+
+	for i, file := range file_mod_ordered {
+		if updated[i] {
+			report_list = append(report_list, file.ID)
+		}
+	}
+
+	if len(report_list) > 0 {
 		fmt.Println("[ø] updated pages\n")
 
-		for _, file := range file_mod_ordered {
-			fmt.Println("   ", file.ID)
+		for _, id := range report_list {
+			fmt.Println("   ", id)
 		}
 
 		for _, file := range secondary_renders {
@@ -171,7 +286,9 @@ func do_static_files() {
 				f.Dir = filepath.Join(file, f.Dir) // @hack
 			}
 
-			file_mod, file_del := compare_files(source, output)
+			file_mod, file_del := compare_files(source, output, func(src, dst *File_Info) bool {
+				return hash_file(filepath.Join(file, src.Path)) != hash_file(filepath.Join(config.Output, file, dst.Path))
+			})
 			path_mod, path_del := compare_dirs(source, output, file_mod, file_del)
 
 			for path, _ := range path_mod {
@@ -196,18 +313,8 @@ func do_static_files() {
 			// single files
 			out_path := filepath.Join(config.Output, file)
 
-			if info, ok := file_data(file); ok {
-				do_copy := false
-
-				if out, ok := file_data(out_path); ok {
-					if info.ModTime().After(out.ModTime()) {
-						do_copy = true
-					}
-				} else {
-					do_copy = true
-				}
-
-				if do_copy {
+			if file_exists(file) {
+				if hash_file(file) != hash_file(out_path) {
 					copy_file(file, out_path)
 					report_list = append(report_list, file)
 				}
@@ -238,16 +345,119 @@ func do_static_files() {
 	}
 }
 
+// adds the pages behind ids to file_mod,
+// skipping any that no longer exist
+func mark_pages(file_mod, source map[string]*File_Info, ids []string) {
+	for _, id := range ids {
+		if f, ok := source[id]; ok {
+			file_mod[id] = f
+		}
+	}
+}
+
+// calls job for 0 to count-1 on as many
+// workers as there are cpus, returning when
+// every call has finished
+func parallel(count int, job func(int)) {
+	workers := runtime.NumCPU()
+
+	if workers > count {
+		workers = count
+	}
+
+	var wait  sync.WaitGroup
+	var fault interface{}
+	var once  sync.Once
+
+	queue := make(chan int)
+
+	for w := 0; w < workers; w++ {
+		wait.Add(1)
+
+		go func() {
+			defer wait.Done()
+
+			// a panic in a worker is handed back
+			// to main so it is still reported
+			defer func() {
+				if r := recover(); r != nil {
+					once.Do(func() { fault = r })
+
+					for range queue {}
+				}
+			}()
+
+			for i := range queue {
+				job(i)
+			}
+		}()
+	}
+
+	for i := 0; i < count; i++ {
+		queue <- i
+	}
+
+	close(queue)
+	wait.Wait()
+
+	if fault != nil {
+		panic(fault)
+	}
+}
+
+func build() {
+	do_pages()
+	do_static_files()
+
+	print_diagnostics()
+}
+
+const usage = `usage: oko [flags]
+
+  -new-config  create _data/oko.json in this directory
+  -all         render every page, changed or not
+  -drafts      render drafts too
+  -watch       rebuild whenever a file changes
+  -serve       watch and serve the site, reloading
+               the browser after each rebuild
+  -port=N      the port -serve listens on, 8080 if
+               not given
+  -help        print this
+`
+
 func main() {
+	// anything that still panics is a bug in oko,
+	// not in the site, so it gets its own exit code
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("[ø] internal error: %v\n\n%s\n", r, debug.Stack())
+			os.Exit(EXIT_INTERNAL)
+		}
+	}()
+
 	new_config   := false
 	do_all_pages := false
 	show_drafts  := false
+	watch        := false
+	serve        := false
+	address      := "localhost:8080"
 
 	for _, arg := range os.Args[1:] {
+		if strings.HasPrefix(arg, "-port=") {
+			address = "localhost:" + arg[6:]
+			continue
+		}
+
 		switch arg[1:] {
 			case "new-config": new_config   = true
 			case "all":        do_all_pages = true
 			case "drafts":     show_drafts  = true
+			case "watch":      watch        = true
+			case "serve":      serve        = true
+
+			case "help", "h":
+				fmt.Print(usage)
+				return
 		}
 	}
 
@@ -257,23 +467,70 @@ func main() {
 		return
 	}
 
-	config = load_config()
+	load := func() bool {
+		config = load_config()
+
+		if config == nil {
+			return false
+		}
+
+		// set config from argument flags
+		if do_all_pages {
+			config.DoAllPages = true
+		}
+		if show_drafts {
+			config.ShowDrafts = true
+		}
+		if serve {
+			config.Serve = true
+		}
+
+		return true
+	}
+
+	if !load() {
+		if has_errors() {
+			print_diagnostics()
+			os.Exit(EXIT_PROJECT)
+		}
 
-	if config == nil {
 		fmt.Println("[ø] not an oko project!")
-		return
+		os.Exit(EXIT_PROJECT)
 	}
 
-	// set config from argument flags
-	if do_all_pages {
+	marker := filepath.Join(config.Output, serve_marker)
+
+	// pages rendered while serving carry the
+	// reload script, so whichever mode runs
+	// next has to render everything again
+	if serve {
+		if !file_exists(marker) {
+			config.DoAllPages = true
+		}
+	} else if file_exists(marker) {
 		config.DoAllPages = true
 	}
-	if show_drafts {
-		config.ShowDrafts = true
-	}
 
-	do_pages()
-	do_static_files()
+	build()
+
+	config.DoAllPages = do_all_pages
+
+	if serve {
+		mkdir(config.Output)
+		os.WriteFile(marker, nil, 0644)
+
+		go do_serve(address, config.Output)
+		do_watch(load)
+
+	} else {
+		if file_exists(marker) {
+			delete_file(marker)
+		}
+
+		if watch {
+			do_watch(load)
+		}
+	}
 
-	print_warnings()
+	exit_on_errors()
 }
\ No newline at end of file
@@ -18,17 +18,19 @@ func image_checker(v string) string {
 	return v
 }
 
-func make_favicon(f string) string {
+func make_favicon(path, f string) string {
 	var tag string
 
 	switch filepath.Ext(f) {
 		case ".ico": tag = `<link rel='icon' type='image/x-icon' href='%s'>`
 		case ".png": tag = `<link rel='icon' type='image/png' href='%s'>`
 		case ".gif": tag = `<link rel='icon' type='image/gif' href='%s'>`
-		default: panic("bad favicon format")
+		default:
+			file_error(path, "unsupported favicon format " + f)
+			return ""
 	}
 
-	return sub_content(tag, f)
+	return sub_attr(tag, f)
 }
 
 //
@@ -89,7 +91,9 @@ func media_youtube(viewcode, ratio string, args []string) string {
 	return iframe
 }
 
-func media(s string) string {
+func media(the_page *Page, tok *Token) string {
+	s := tok.Text
+
 	if s == "" {
 		return ""
 	}
@@ -111,8 +115,13 @@ func media(s string) string {
 		if strings.Contains(args[1], ":") {
 			v := strings.SplitN(args[1], ":", 2)
 
-			x, err := strconv.ParseFloat(v[0], 32); if err != nil { panic(err) }
-			y, err := strconv.ParseFloat(v[1], 32); if err != nil { panic(err) }
+			x, err_x := strconv.ParseFloat(v[0], 32)
+			y, err_y := strconv.ParseFloat(v[1], 32)
+
+			if err_x != nil || err_y != nil || x == 0 {
+				page_error(the_page, tok, "bad aspect ratio " + args[1])
+				return ""
+			}
 
 			ratio = fmt.Sprintf(` style="padding-top: %.2f%%"`, y / x * 100.0)
 		}
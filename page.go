@@ -1,6 +1,7 @@
 package main
 
 import (
+	"time"
 	"strings"
 	"path/filepath"
 )
@@ -18,14 +19,26 @@ type Page struct {
 
 	CurrentParent *Page // @hack
 
+	// the page an each block is repeating for
+	// while its block renders, see each_page
+	EachItem *Page
+
+	// what a generated page came from: the ID
+	// of its source page, or taxonomy_<name>;
+	// empty for pages with a source file
+	Origin string
+
 	IsDraft bool
+	Failed  bool // see page_error
 	Format  File_Format
+	Mod     time.Time
 
 	Plate      *Plate
 	List       *Token_List
 
 	Vars       map[string]string
 	Meta       map[string]string
+	Typed      map[string]*Value
 }
 
 func make_page(info *File_Info) *Page {
@@ -33,27 +46,90 @@ func make_page(info *File_Info) *Page {
 		return p
 	}
 
-	output := filepath.Join(config.Output, info.ID + ".html")
-
 	new_page := &Page{
 		ID: info.ID,
 		SourcePath: info.Path,
-		OutputPath: output,
 		Format: info.Format,
+		Mod: info.Mod,
 	}
 
-	new_page.Vars = make(map[string]string, 8)
-	new_page.Meta = make(map[string]string, 8)
+	new_page.Vars  = make(map[string]string, 8)
+	new_page.Meta  = make(map[string]string, 8)
+	new_page.Typed = make(map[string]*Value, 8)
 
-	if info.ID == "index" {
-		new_page.URLPath = ""
-	} else {
-		new_page.URLPath = "/" + strings.Replace(info.ID, "/index", "", 1)
+	if t := output_target(info.ID); t != info.ID {
+		info.Target = t
 	}
 
-	new_page.Vars["page_path"] = new_page.URLPath
+	set_output(new_page, info.ID)
 
 	PageList[info.ID] = new_page
 
 	return new_page
+}
+
+// with pretty_urls every page is written as
+// the index of its own directory, so servers
+// that don't rewrite /about can still find
+// about/index.html
+func output_target(id string) string {
+	if !config.PrettyURLs || id == "index" || strings.HasSuffix(id, "/index") {
+		return id
+	}
+	return id + "/index"
+}
+
+// pretty urls always end in a slash, others
+// never do
+func url_path(id string) string {
+	if id == "index" {
+		if config.PrettyURLs {
+			return "/"
+		}
+		return ""
+	}
+
+	path := "/" + strings.Replace(id, "/index", "", 1)
+
+	if config.PrettyURLs {
+		path += "/"
+	}
+
+	return path
+}
+
+// points a page at the output it is written
+// to, its ID unless a permalink moved it
+func set_output(the_page *Page, id string) {
+	the_page.OutputPath = filepath.Join(config.Output, filepath.FromSlash(output_target(id)) + ".html")
+	the_page.URLPath    = url_path(id)
+
+	the_page.Vars["page_path"] = the_page.URLPath
+}
+
+// the ID of a page's output, which is where
+// pages generated from it go as well
+func output_id(the_page *Page) string {
+	rel, _ := filepath.Rel(config.Output, the_page.OutputPath)
+	return strings.TrimSuffix(filepath.ToSlash(rel), ".html")
+}
+
+// the variables a page substitutes: project
+// vars from _data/oko.json, overridden by the
+// page's own
+func page_vars(the_page *Page) map[string]string {
+	if len(config.Vars) == 0 {
+		return the_page.Vars
+	}
+
+	merged := make(map[string]string, len(config.Vars) + len(the_page.Vars))
+
+	for k, v := range config.Vars {
+		merged[k] = v
+	}
+	for k, v := range the_page.Vars {
+		merged[k] = v
+	}
+
+	return merged
 }
\ No newline at end of file
@@ -1,19 +1,41 @@
 package main
 
 import (
+	"sync"
 	"bytes"
+	"regexp"
 	"strings"
 	"unicode"
 )
 
 var DepTree = make(map[string][]string)
 
+// DepTree is written to while pages render in
+// parallel, so every addition goes through here
+var dep_mutex sync.Mutex
+
+func add_dependency(name string, ids ...string) {
+	dep_mutex.Lock()
+	DepTree[name] = append(DepTree[name], ids...)
+	dep_mutex.Unlock()
+}
+
+var code_if_statement = regexp.MustCompile(`^\s*(\}\s*else\s+)?if\s+!?(page|parent|project)\b.*[^\\]\{\s*$`)
+
+// the same line with its brace escaped, as
+// the code block error asks, made plain again
+var code_if_escaped = regexp.MustCompile(`(?m)^(\s*(\}\s*else\s+)?if\s+!?(page|parent|project)\b.*)\\\{(\s*)$`)
+
 type Token struct {
 	Type Token_Type
 	Offset uint8
 	Text string
 	Line int
 	Vars map[string]string
+
+	// an IF_EXPRESSION's condition, parsed once
+	// here instead of on every render
+	cond *If_Node
 }
 
 type Token_Type int
@@ -45,6 +67,9 @@ const (
 	BLOCK_CLOSE
 	CODE_GUTS
 	HTML_SNIPPET
+	ELSE
+	ELSE_IF
+	BLOCK_EACH
 
 	tok_if_statements
 
@@ -54,6 +79,7 @@ const (
 	IF_SCOPE_PARENT_NOT
 	IF_SCOPE_PAGE
 	IF_SCOPE_PAGE_NOT
+	IF_EXPRESSION
 )
 
 var token_names = [...]string {
@@ -83,6 +109,9 @@ var token_names = [...]string {
 	"block_close",
 	"code_guts",
 	"html_snippet",
+	"else",
+	"else_if",
+	"block_each",
 
 	"if_statements",
 
@@ -92,6 +121,7 @@ var token_names = [...]string {
 	"if_scope_parent_not",
 	"if_scope_page",
 	"if_scope_page_not",
+	"if_expression",
 }
 
 func (t Token_Type) String() string {
@@ -99,12 +129,14 @@ func (t Token_Type) String() string {
 }
 
 func convert_token_offset(tok *Token) (string, string) {
-	if tok.Offset > 6 {
-		tok.Offset = uint8(1)
+	offset := tok.Offset
+
+	if offset > 6 {
+		offset = uint8(1)
 	}
 
 	if tok.Type == HEADING {
-		switch tok.Offset {
+		switch offset {
 			case 1: return "h1", "h1"
 			case 2: return "h2", "h2"
 			case 3: return "h3", "h3"
@@ -116,7 +148,7 @@ func convert_token_offset(tok *Token) (string, string) {
 
 	id := tok.Type.String()
 
-	switch tok.Offset {
+	switch offset {
 		case 1: return id, id
 		case 2: return id + "2", id
 		case 3: return id + "3", id
@@ -174,6 +206,9 @@ func simple_oko_token(input []rune, r rune) ([]rune, []rune, bool) {
 
 func compare_arbitrary_runes(input []rune, compare string) (int, bool) {
 	test := []rune(compare)
+	if len(input) < len(test) {
+		return 0, false
+	}
 	for i, r := range test {
 		if r != input[i] {
 			return 0, false
@@ -228,6 +263,17 @@ func consume_whitespace(input []rune) []rune {
 	return input[len(input):]
 }
 
+// like consume_whitespace, but stays on the
+// current line
+func consume_spaces(input []rune) []rune {
+	for i, r := range input {
+		if r != ' ' && r != '\t' {
+			return input[i:]
+		}
+	}
+	return input[len(input):]
+}
+
 func count_newlines(input []rune) int {
 	c := 0
 	for _, r := range input {
@@ -267,7 +313,6 @@ func get(a []*Token) (*Token, bool) {
 
 
 
-// @note block open/close balance checking pass?
 func parser(page *Page, source []byte) *Token_List {
 	input := bytes.Runes(source)
 
@@ -283,6 +328,68 @@ func parser(page *Page, source []byte) *Token_List {
 	var list []*Token
 	var active_block []*Token
 
+	// errors found in block headers are kept
+	// apart so they can't break an else chain
+	var if_errors []*Token
+
+	// parses the condition of an if-statement,
+	// starting right after the "if"; a broken
+	// condition still opens a block, one that is
+	// never true, so its '}' stays balanced
+	parse_if := func(if_input []rune) *Token {
+		if_token := &Token{}
+		if_token.Vars = make(map[string]string)
+		if_token.Line = line_no(if_input)
+
+		cond := string(extract_to_newline(if_input))
+		cond  = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(cond), "{"))
+
+		node, err := parse_condition(cond)
+
+		if err != nil {
+			if_errors = append(if_errors, &Token{ERROR, 0, err.Error(), if_token.Line, nil, nil})
+
+			if_token.Type = IF_SCOPE_PROJECT
+			return if_token
+		}
+
+		if condition_uses(node, "parent") {
+			committable = false
+		}
+
+		// a lone, possibly negated, variable keeps
+		// its own token type and skips evaluation
+		is_not := false
+		single := node
+
+		if single.Op == "!" && single.Left.Op == "" {
+			is_not = true
+			single = single.Left
+		}
+
+		if single.Op != "" || single.Scope == "" {
+			if_token.Type = IF_EXPRESSION
+			if_token.Text = cond
+			if_token.cond = node
+			return if_token
+		}
+
+		if_token.Text = single.Name
+
+		switch single.Scope {
+			case "project": if_token.Type = IF_SCOPE_PROJECT
+			case "parent":  if_token.Type = IF_SCOPE_PARENT
+			case "page":    if_token.Type = IF_SCOPE_PAGE
+		}
+
+		// the _NOT variants always follow
+		if is_not {
+			if_token.Type++
+		}
+
+		return if_token
+	}
+
 	for len(input) > 0 {
 		input = consume_whitespace(input)
 
@@ -293,10 +400,51 @@ func parser(page *Page, source []byte) *Token_List {
 		if input[0] == '}' {
 			input = input[1:]
 
-			list = append(list, &Token{BLOCK_CLOSE, 0, "", line_no(input), nil})
+			list = append(list, &Token{BLOCK_CLOSE, 0, "", line_no(input), nil, nil})
 
 			active_block = pop(active_block)
 
+			// "} else {" and "} else if x {" continue
+			// the chain on the same line
+			else_input := consume_spaces(input)
+
+			if count, ok := compare_arbitrary_runes(else_input, "else"); ok {
+				rest := else_input[count:]
+
+				if len(rest) > 0 && (rest[0] == '{' || rest[0] == ' ' || rest[0] == '\t') {
+					else_input = consume_spaces(rest)
+					c := jump_to_next_newline(else_input)
+
+					if len(else_input) > 0 && else_input[0] == '{' {
+						b := &Token{ELSE, 0, "", line_no(else_input), nil, nil}
+						b.Vars = make(map[string]string)
+
+						list = append(list, b)
+						active_block = append(active_block, b)
+
+						input = else_input[1:]
+						continue
+					}
+
+					if count, ok := compare_arbitrary_runes(else_input, "if "); ok && else_input[c-1] == '{' {
+						list = append(list, &Token{ELSE_IF, 0, "", line_no(else_input), nil, nil})
+
+						if_token := parse_if(consume_spaces(else_input[count:]))
+
+						list = append(list, if_token)
+						active_block = append(active_block, if_token)
+
+						input = else_input[c:]
+						continue
+					}
+
+					if_errors = append(if_errors, &Token{ERROR, 0, "expected '{' or 'if' after else", line_no(else_input), nil, nil})
+
+					input = else_input[c:]
+					continue
+				}
+			}
+
 			continue
 		}
 
@@ -312,7 +460,7 @@ func parser(page *Page, source []byte) *Token_List {
 			text  := extract_to_newline(input)
 			input  = input[len(text):]
 
-			list = append(list, &Token{HEADING, uint8(c), string(text), line_no(input), nil})
+			list = append(list, &Token{HEADING, uint8(c), string(text), line_no(input), nil, nil})
 			continue
 		}
 		if input[0] == '%' {
@@ -321,7 +469,7 @@ func parser(page *Page, source []byte) *Token_List {
 			text  := extract_to_newline(input)
 			input  = input[len(text):]
 
-			list = append(list, &Token{IMAGE, uint8(c), string(text), line_no(input), nil})
+			list = append(list, &Token{IMAGE, uint8(c), string(text), line_no(input), nil, nil})
 			continue
 		}
 		if input[0] == '&' {
@@ -330,7 +478,7 @@ func parser(page *Page, source []byte) *Token_List {
 			text  := extract_to_newline(input)
 			input  = input[len(text):]
 
-			list = append(list, &Token{TOKEN, uint8(c), string(text), line_no(input), nil})
+			list = append(list, &Token{TOKEN, uint8(c), string(text), line_no(input), nil, nil})
 			continue
 		}
 		if input[0] == '$' {
@@ -339,13 +487,13 @@ func parser(page *Page, source []byte) *Token_List {
 			text  := extract_to_newline(input)
 			input  = input[len(text):]
 
-			list = append(list, &Token{QUOTE, uint8(c), string(text), line_no(input), nil})
+			list = append(list, &Token{QUOTE, uint8(c), string(text), line_no(input), nil, nil})
 			continue
 		}
 
 		if text, update_input, ok := simple_oko_token(input, '@'); ok {
 			input = update_input
-			list = append(list, &Token{MEDIA, 0, string(text), line_no(input), nil})
+			list = append(list, &Token{MEDIA, 0, string(text), line_no(input), nil, nil})
 			continue
 		}
 
@@ -355,9 +503,9 @@ func parser(page *Page, source []byte) *Token_List {
 			t     := string(text)
 			name  := strings.SplitN(t, " ", 2)[0]
 
-			DepTree[name]    = append(DepTree[name], page.ID)
+			add_dependency(name, page.ID)
 
-			list = append(list, &Token{IMPORT, 0, t, line_no(input), nil})
+			list = append(list, &Token{IMPORT, 0, t, line_no(input), nil, nil})
 			continue
 		}
 		if text, update_input, ok := simple_oko_token(input, '>'); ok {
@@ -365,26 +513,34 @@ func parser(page *Page, source []byte) *Token_List {
 			t     := string(text)
 			name  := "snip_" + t
 
-			DepTree[name] = append(DepTree[name], page.ID)
+			add_dependency(name, page.ID)
 
-			list = append(list, &Token{SNIPPET, 0, t, line_no(input), nil})
+			list = append(list, &Token{SNIPPET, 0, t, line_no(input), nil, nil})
 			continue
 		}
 		if text, update_input, ok := simple_oko_token(input, 'ø'); ok {
 			input  = update_input
-			t     := string(text)
-			name  := "func_" + t
 
-			DepTree[name] = append(DepTree[name], page.ID)
+			t, args, err := parse_function_args(string(text))
+
+			// the dependency is on the script, not
+			// the call, so any arguments share it
+			name := "func_" + t
+
+			add_dependency(name, page.ID)
+
+			list = append(list, &Token{FUNCTION, 0, t, line_no(input), args, nil})
 
-			list = append(list, &Token{FUNCTION, 0, t, line_no(input), nil})
+			if err != nil {
+				list = append(list, &Token{ERROR, 0, err.Error(), line_no(input), nil, nil})
+			}
 			continue
 		}
 
 		// force characters
 		if text, update_input, ok := simple_oko_token(input, '.'); ok {
 			input = update_input
-			list = append(list, &Token{PARAGRAPH, 0, string(text), line_no(input), nil})
+			list = append(list, &Token{PARAGRAPH, 0, string(text), line_no(input), nil, nil})
 			continue
 		}
 
@@ -393,20 +549,20 @@ func parser(page *Page, source []byte) *Token_List {
 			input  = input[2:]
 			text  := extract_to_newline(input)
 			input  = input[len(text):]
-			list   = append(list, &Token{HTML_SNIPPET, 0, string(text), line_no(input), nil})
+			list   = append(list, &Token{HTML_SNIPPET, 0, string(text), line_no(input), nil, nil})
 			continue
 		}
 
 		if input[0] == '-' {
 			if count_sequential_runes(input, '-') == 3 {
 				input = input[3:]
-				list = append(list, &Token{DIVIDER, 0, "", line_no(input), nil})
+				list = append(list, &Token{DIVIDER, 0, "", line_no(input), nil, nil})
 				continue
 			}
 
 			if text, update_input, ok := simple_oko_token(input, '-'); ok {
 				input = update_input
-				list = append(list, &Token{LIST_ENTRY, 0, string(text), line_no(input), nil})
+				list = append(list, &Token{LIST_ENTRY, 0, string(text), line_no(input), nil, nil})
 				continue
 			}
 		}
@@ -418,7 +574,7 @@ func parser(page *Page, source []byte) *Token_List {
 			test_input := consume_whitespace(input[len(ident):])
 
 			// we are a variable
-			if test_input[0] == ':' {
+			if len(test_input) > 0 && test_input[0] == ':' {
 				test_input = consume_whitespace(test_input[1:])
 
 				value := extract_to_newline(test_input)
@@ -456,7 +612,8 @@ func parser(page *Page, source []byte) *Token_List {
 						if a, ok := get(active_block); ok {
 							a.Vars[k] = v
 						} else {
-							page.Vars[k] = v
+							page.Typed[k] = parse_value(k, v)
+							page.Vars[k]  = page.Typed[k].Text
 						}
 				}
 
@@ -466,7 +623,7 @@ func parser(page *Page, source []byte) *Token_List {
 			c := jump_to_next_newline(test_input)
 
 			// we are a block
-			if test_input[c-1] == '{' {
+			if c > 0 && test_input[c-1] == '{' {
 				str_ident := string(ident)
 
 				if str_ident == "code" {
@@ -476,11 +633,15 @@ func parser(page *Page, source []byte) *Token_List {
 						lang = ""
 					}
 
-					test_input = test_input[c+1:]
+					if c < len(test_input) {
+						test_input = test_input[c+1:]
+					} else {
+						test_input = test_input[c:]
+					}
 					// subtract from line_no  ^ because we sliced it off just above
 					n := line_no(test_input) - 1
 
-					list = append(list, &Token{BLOCK_CODE, 0, lang, n, nil})
+					list = append(list, &Token{BLOCK_CODE, 0, lang, n, nil, nil})
 
 					var indent   int
 					var count    int
@@ -495,7 +656,7 @@ func parser(page *Page, source []byte) *Token_List {
 					}
 
 					brace_balance := 1
-					last := test_input[0]
+					last := rune(0)
 
 					for _, r := range test_input {
 						if r == '{' && last != '\\' {
@@ -529,12 +690,32 @@ func parser(page *Page, source []byte) *Token_List {
 					code := string(content)
 
 					// @hack replace me
-					code  = strings.ReplaceAll(code, "\n" + strings.Repeat("\t", indent), "\n")[indent:]
+					code  = strings.ReplaceAll(code, "\n" + strings.Repeat("\t", indent), "\n")
+
+					if len(code) >= indent {
+						code = code[indent:]
+					}
 
 					code  = strings.ReplaceAll(code, "\t", "    ")
 					code  = strings.ReplaceAll(code, "\\}", "}")
+					code  = code_if_escaped.ReplaceAllString(code, "${1}{${4}")
+
+					list = append(list, &Token{CODE_GUTS, 0, code, n+1, nil, nil})
+
+					if brace_balance != 0 {
+						// an if-statement in here is never run;
+						// when its brace is what leaves the
+						// block open, say so where it is
+						for i, line := range strings.Split(string(content), "\n") {
+							if code_if_statement.MatchString(line) {
+								list = append(list, &Token{ERROR, 0, "if-statement inside code block, escape its brace as \\{ if this is intended", n+1+i, nil, nil})
+							}
+						}
 
-					list = append(list, &Token{CODE_GUTS, 0, code, n+1, nil})
+						list  = append(list, &Token{ERROR, 0, "unclosed code block", n, nil, nil})
+						input = test_input[count:]
+						continue
+					}
 
 					input = test_input[count+1:]
 
@@ -543,81 +724,32 @@ func parser(page *Page, source []byte) *Token_List {
 
 				// if statement
 				if str_ident == "if" {
-					if_token := Token{}
-					if_input := test_input
+					if_token := parse_if(test_input)
 
-					found_valid_scope := false
-					is_not := false
+					list = append(list, if_token)
+					active_block = append(active_block, if_token)
 
-					if if_input[0] == '!' {
-						if_input = if_input[1:]
-						is_not   = true
-					}
-
-					if count, ok := compare_arbitrary_runes(if_input, "project"); ok {
-						if_input = consume_whitespace(if_input[count:])
-						found_valid_scope = true
-
-						if is_not {
-							if_token.Type = IF_SCOPE_PROJECT_NOT
-						} else {
-							if_token.Type = IF_SCOPE_PROJECT
-						}
-
-					} else if count, ok := compare_arbitrary_runes(if_input, "parent"); ok {
-						if_input = consume_whitespace(if_input[count:])
-						found_valid_scope = true
-
-						committable = false
-
-						if is_not {
-							if_token.Type = IF_SCOPE_PARENT_NOT
-						} else {
-							if_token.Type = IF_SCOPE_PARENT
-						}
+				} else if str_ident == "each" {
+					text := strings.TrimSpace(string(test_input[:c-1]))
+					b    := &Token{BLOCK_EACH, 0, text, line_no(test_input), nil, nil}
+					b.Vars = make(map[string]string)
 
-					} else if count, ok := compare_arbitrary_runes(if_input, "page"); ok {
-						if_input = consume_whitespace(if_input[count:])
-						found_valid_scope = true
+					if args, err := parse_each(text); err == nil {
+						name := "each_" + args.Pattern
+						add_dependency(name, page.ID)
 
-						if is_not {
-							if_token.Type = IF_SCOPE_PAGE_NOT
-						} else {
-							if_token.Type = IF_SCOPE_PAGE
+						if strings.HasPrefix(args.Pattern, "data.") {
+							data_dependency(page, args.Pattern[5:])
 						}
-					}
-
-					if !found_valid_scope {
-						ident := extract_identifier(if_input)
-						list = append(list, &Token{ERROR, 0, "no such scope " + string(ident), line_no(if_input), nil})
-						continue
-					}
-
-					if if_input[0] == '.' {
-						if_input = if_input[1:]
 					} else {
-						list = append(list, &Token{ERROR, 0, "missing '.' separator in if-statement", line_no(if_input), nil})
-						continue
+						if_errors = append(if_errors, &Token{ERROR, 0, err.Error(), b.Line, nil, nil})
 					}
 
-					ident := extract_identifier(if_input)
-
-					if len(ident) > 0 {
-						if_input = if_input[len(ident):]
-					} else {
-						list = append(list, &Token{ERROR, 0, "no variable in if-statement", line_no(if_input), nil})
-						continue
-					}
-
-					if_token.Text = string(ident)
-					if_token.Line = line_no(if_input)
-					if_token.Vars = make(map[string]string)
-
-					list = append(list, &if_token)
-					active_block = append(active_block, &if_token)
+					list = append(list, b)
+					active_block = append(active_block, b)
 
 				} else {
-					b := &Token{BLOCK_START, 0, str_ident, line_no(test_input), nil}
+					b := &Token{BLOCK_START, 0, str_ident, line_no(test_input), nil, nil}
 					b.Vars = make(map[string]string)
 					list = append(list, b)
 					active_block = append(active_block, b)
@@ -631,44 +763,145 @@ func parser(page *Page, source []byte) *Token_List {
 
 		// PARAGRAPH
 		text := extract_to_newline(input)
-		list  = append(list, &Token{PARAGRAPH, 0, string(text), line_no(input), nil})
+		list  = append(list, &Token{PARAGRAPH, 0, string(text), line_no(input), nil, nil})
 		input = input[len(text):]
 	}
 
 	if name, ok := page.Vars["plate"]; ok {
 		n := "plate_" + name
-		DepTree[n] = append(DepTree[n], page.ID)
+		add_dependency(n, page.ID)
 
 		plate := load_plate(name)
 
 		if len(plate.SnippetBefore) > 0 {
 			for _, s := range plate.SnippetBefore {
 				name := "snip_" + s
-				DepTree[name] = append(DepTree[name], page.ID)
+				add_dependency(name, page.ID)
 			}
 		}
 
 		if len(plate.SnippetAfter) > 0 {
 			for _, s := range plate.SnippetAfter {
 				name := "snip_" + s
-				DepTree[name] = append(DepTree[name], page.ID)
+				add_dependency(name, page.ID)
 			}
 		}
 
 		if len(plate.BodyBefore) > 0 {
 			for _, s := range plate.BodyBefore {
 				name := "snip_" + s
-				DepTree[name] = append(DepTree[name], page.ID)
+				add_dependency(name, page.ID)
 			}
 		}
 
 		if len(plate.BodyAfter) > 0 {
 			for _, s := range plate.BodyAfter {
 				name := "snip_" + s
-				DepTree[name] = append(DepTree[name], page.ID)
+				add_dependency(name, page.ID)
 			}
 		}
 	}
 
+	list = append(list, if_errors...)
+	list = check_balance(list)
+	list = check_variables(list)
+
+	variable_dependencies(page, list)
+
 	return &Token_List{Tokens: list, IsCommittable:committable}
+}
+
+// every opened block must be closed exactly
+// once; a stray '}' becomes an error in place
+// so it can't close a block it doesn't belong
+// to, unclosed blocks are reported where they
+// were opened
+func check_balance(list []*Token) []*Token {
+	var open []*Token
+	var last_closed *Token
+
+	for i, tok := range list {
+		switch {
+			case tok.Type == ELSE || tok.Type == ELSE_IF:
+				// an else has to follow the '}' of an if
+				// or an else if directly
+				follows_if := i > 0 && list[i-1].Type == BLOCK_CLOSE &&
+					last_closed != nil && last_closed.Type > tok_if_statements
+
+				if !follows_if {
+					if tok.Type == ELSE {
+						list = append(list, &Token{ERROR, 0, "else without an if", tok.Line, nil, nil})
+
+						// never true, but still a block
+						tok.Type = IF_SCOPE_PROJECT
+						tok.Text = ""
+					} else {
+						tok.Type = ERROR
+						tok.Text = "else if without an if"
+						continue
+					}
+				}
+
+				if tok.Type != ELSE_IF {
+					open = append(open, tok)
+				}
+
+			case tok.Type == BLOCK_START || tok.Type == BLOCK_EACH || tok.Type > tok_if_statements:
+				open = append(open, tok)
+
+			case tok.Type == BLOCK_CLOSE:
+				if len(open) == 0 {
+					tok.Type = ERROR
+					tok.Text = "'}' without an open block"
+					continue
+				}
+				last_closed, _ = get(open)
+				open = pop(open)
+		}
+	}
+
+	for _, tok := range open {
+		name := "if-statement"
+
+		switch tok.Type {
+			case BLOCK_START: name = "block " + tok.Text
+			case BLOCK_EACH:  name = "each"
+			case ELSE:        name = "else"
+		}
+
+		list = append(list, &Token{ERROR, 0, "unclosed " + name + ", missing '}'", tok.Line, nil, nil})
+	}
+
+	return list
+}
+
+// reports every ${ that is never closed, which
+// mapmap would otherwise leave in the output
+func check_variables(list []*Token) []*Token {
+	for _, tok := range list {
+		if tok.Type == ERROR || tok.Type == CODE_GUTS {
+			continue
+		}
+
+		text := tok.Text
+
+		for {
+			pos := strings.Index(text, "${")
+
+			if pos < 0 {
+				break
+			}
+
+			end := strings.IndexRune(text[pos:], '}')
+
+			if end < 0 {
+				list = append(list, &Token{ERROR, 0, "unclosed variable " + text[pos:], tok.Line, nil, nil})
+				break
+			}
+
+			text = text[pos+end:]
+		}
+	}
+
+	return list
 }
\ No newline at end of file
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"path/filepath"
+)
+
+// url: /about-us/
+//
+// moves a single page; the project can move
+// every page at once with a pattern in
+// _data/oko.json
+//
+//     "permalink": "/:section/:year/:slug/"
+//
+// :section  the first directory of the page's ID
+// :path     every directory of the page's ID
+// :year     the year of the date variable, also
+//           :month and :day
+// :slug     the slug variable, or the file name
+// :title    the title, made safe for a url
+//
+// a trailing slash writes dir/index.html; index
+// pages, and pages missing a value the pattern
+// uses, stay where their source file puts them
+func permalink_target(the_page *Page) (string, bool) {
+	if url, ok := the_page.Vars["url"]; ok {
+		return permalink_url(the_page, url)
+	}
+
+	if config.Permalink == "" {
+		return "", false
+	}
+
+	if the_page.ID == "index" || strings.HasSuffix(the_page.ID, "/index") {
+		return "", false
+	}
+
+	dir  := filepath.ToSlash(filepath.Dir(filepath.FromSlash(the_page.ID)))
+	name := filepath.Base(filepath.FromSlash(the_page.ID))
+
+	if dir == "." {
+		dir = ""
+	}
+
+	section := strings.SplitN(dir, "/", 2)[0]
+
+	var out strings.Builder
+
+	pattern := config.Permalink
+
+	for len(pattern) > 0 {
+		n := strings.IndexRune(pattern, ':')
+
+		if n < 0 {
+			out.WriteString(pattern)
+			break
+		}
+
+		out.WriteString(pattern[:n])
+		pattern = pattern[n+1:]
+
+		end := strings.IndexAny(pattern, "/-_.")
+
+		if end < 0 {
+			end = len(pattern)
+		}
+
+		token  := pattern[:end]
+		pattern = pattern[end:]
+
+		value := ""
+
+		switch token {
+			case "section":
+				value = section
+
+			case "path":
+				value = dir
+
+			case "slug":
+				value = the_page.Vars["slug"]
+
+				if value == "" {
+					value = name
+				}
+
+			case "title":
+				value = make_element_id(the_page.Vars["title"])
+
+			case "year", "month", "day":
+				date, ok := parse_date(the_page.Vars["date"])
+
+				if !ok {
+					return "", false
+				}
+
+				switch token {
+					case "year":  value = date.Format("2006")
+					case "month": value = date.Format("01")
+					case "day":   value = date.Format("02")
+				}
+
+			default:
+				file_error("_data/oko.json", "unknown permalink field :" + token)
+				return "", false
+		}
+
+		if value == "" && token != "section" && token != "path" {
+			return "", false
+		}
+
+		out.WriteString(value)
+	}
+
+	return permalink_url(the_page, out.String())
+}
+
+func permalink_url(the_page *Page, url string) (string, bool) {
+	id, ok := url_target(url)
+
+	if !ok {
+		file_error(the_page.SourcePath, "permalink " + url + " leaves the output directory")
+	}
+	return id, ok
+}
+
+// "/blog/2021/post/" -> "blog/2021/post/index"
+//
+// urls climbing out with ".." are refused, so
+// nothing is written outside the output
+func url_target(url string) (string, bool) {
+	url = strings.TrimSpace(url)
+	url = strings.TrimSuffix(url, ".html")
+
+	// empty sections don't leave "//" behind
+	for strings.Contains(url, "//") {
+		url = strings.ReplaceAll(url, "//", "/")
+	}
+
+	id := strings.TrimPrefix(url, "/")
+
+	if strings.Contains(id, "..") {
+		return "", false
+	}
+
+	if id == "" || strings.HasSuffix(id, "/") {
+		id += "index"
+	}
+
+	return id, true
+}
+
+// moves every page with a permalink, before
+// anything is generated from them; two pages
+// can't share an output, the first by ID keeps
+// it
+func permalinks(source map[string]*File_Info) {
+	ids := make([]string, 0, len(PageList))
+
+	for id := range PageList {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	// where every page wants to go, so the
+	// pages that stay put can claim their IDs
+	// before the others move; a page may take
+	// an ID another page moved away from
+	targets := make(map[string]string, len(ids))
+
+	for _, id := range ids {
+		page := PageList[id]
+
+		if _, ok := page.Vars["generate"]; ok {
+			continue
+		}
+
+		if target, ok := permalink_target(page); ok && target != id {
+			targets[id] = target
+		}
+	}
+
+	taken := make(map[string]string, len(ids))
+
+	for _, id := range ids {
+		if _, ok := targets[id]; !ok {
+			taken[id] = id
+		}
+	}
+
+	for _, id := range ids {
+		page := PageList[id]
+
+		target, ok := targets[id]
+
+		if !ok {
+			continue
+		}
+
+		// a page that can't move stays where it
+		// is, which nothing else may take now
+		if other, ok := taken[target]; ok {
+			file_error(page.SourcePath, "permalink " + target + " is already used by " + other)
+
+			if _, ok := taken[id]; !ok {
+				taken[id] = id
+			}
+			continue
+		}
+
+		taken[target] = id
+
+		set_output(page, target)
+		source[id].Target = output_target(target)
+	}
+}
\ No newline at end of file
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"sync"
 	"strings"
 	"encoding/json"
 )
 
 var PlateList = make(map[string]*Plate)
 
+var plate_mutex sync.Mutex
+
 type Plate struct {
 	Extends       string
 
@@ -76,6 +79,9 @@ func plate_path(name string) string {
 }
 
 func load_plate(name string) *Plate {
+	plate_mutex.Lock()
+	defer plate_mutex.Unlock()
+
 	if plate, ok := PlateList[name]; ok {
 		return plate
 	}
@@ -83,11 +89,22 @@ func load_plate(name string) *Plate {
 	var plate Plate
 
 	path := plate_path(name)
-	err  := json.Unmarshal(load_file_bytes(path), &plate)
+
+	// broken plates fall back to the default so
+	// every other problem still gets reported
+	if !file_exists(path) {
+		file_error(path, "no such plate " + name)
+		PlateList[name] = default_plate
+		return default_plate
+	}
+
+	source := load_file_bytes(path)
+	err    := json.Unmarshal(source, &plate)
 
 	if err != nil {
-		// @error
-		panic(sub_sprint(`failed to parse JSON in "%s"\nerror: "%s"`, path, err.Error()))
+		json_error(path, source, err)
+		PlateList[name] = default_plate
+		return default_plate
 	}
 
 	// do this in case the child plate has no
@@ -101,11 +118,17 @@ func load_plate(name string) *Plate {
 	if plate.Extends != "" {
 		var extend Plate
 
-		err  := json.Unmarshal(load_file_bytes(plate_path(plate.Extends)), &extend)
+		extend_path := plate_path(plate.Extends)
+
+		if file_exists(extend_path) {
+			extend_source := load_file_bytes(extend_path)
+			err := json.Unmarshal(extend_source, &extend)
 
-		if err != nil {
-			// @error
-			panic(sub_sprint(`failed to parse JSON in "%s"\nerror: "%s"`, path, err.Error()))
+			if err != nil {
+				json_error(extend_path, extend_source, err)
+			}
+		} else {
+			file_error(path, "no such plate to extend " + plate.Extends)
 		}
 
 		// merge
@@ -18,6 +18,7 @@ type Config struct {
 	ShowDrafts      bool `json:"show_drafts"`
 
 	DoCodeHighlight bool `json:"code_highlight"`
+	Serve           bool `json:"-"`
 	Sitemap bool
 
 	Style      []string
@@ -28,6 +29,27 @@ type Config struct {
 
 	Meta map[string]string
 	Vars map[string]string
+
+	Taxonomies map[string]*Taxonomy
+
+	Permalink  string
+	PrettyURLs bool `json:"pretty_urls"`
+	Redirects  string
+
+	Feed *Feed_Config
+
+	Functions *Function_Config
+}
+
+// "taxonomies": { "tags": { "plate": "tag", "index_plate": "tags" } }
+//
+// every distinct value of the tags variable
+// gets a listing page at /tags/<term>, and
+// /tags lists the terms
+type Taxonomy struct {
+	Path       string // output directory, defaults to the name
+	Plate      string
+	IndexPlate string `json:"index_plate"`
 }
 
 func load_config() *Config {
@@ -39,14 +61,17 @@ func load_config() *Config {
 		return nil
 	}
 
-	err := json.Unmarshal(load_file_bytes(p), &config)
+	source := load_file_bytes(p)
+	err    := json.Unmarshal(source, &config)
 
 	if err != nil {
-		panic(err)
+		json_error(p, source, err)
+		return nil
 	}
 
 	if config.Domain == "" {
-		panic("no domain name in _data/oko.json!")
+		file_error(p, "no domain name")
+		return nil
 	}
 
 	if !strings.HasPrefix(config.Domain, "https://") {
@@ -58,13 +83,26 @@ func load_config() *Config {
 	}
 
 	if config.Favicon != "" {
-		config.Favicon = make_favicon(config.Favicon)
+		config.Favicon = make_favicon(p, config.Favicon)
 	}
 
 	if config.Vars == nil {
 		config.Vars = make(map[string]string, 8)
 	}
 
+	for name, tax := range config.Taxonomies {
+		if tax == nil {
+			tax = &Taxonomy{}
+			config.Taxonomies[name] = tax
+		}
+		if tax.Path == "" {
+			tax.Path = name
+		}
+		if tax.IndexPlate == "" {
+			tax.IndexPlate = tax.Plate
+		}
+	}
+
 	if len(config.Extensions) == 0 {
 		config.Extensions = []string{`.ø`, `.html`}
 	} else {
@@ -82,6 +120,13 @@ func load_config() *Config {
 		}
 	}
 
+	if config.Functions == nil {
+		config.Functions = &Function_Config{}
+	}
+	if config.Functions.Timeout <= 0 {
+		config.Functions.Timeout = default_function_timeout
+	}
+
 	config.StyleRender = render_style(config.Style, ``)
 
 	return &config
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"path/filepath"
+)
+
+// aliases: /old-path, /2019/old-slug
+//
+// every alias gets a small page that sends
+// browsers on to the page that declared it;
+// "redirects": "netlify" or "nginx" in
+// _data/oko.json also lists them for the
+// server, in _redirects or redirects.map
+var Redirects = make(map[string]*Page)
+
+const redirect_source = `<!DOCTYPE html><html><head><title>Redirecting…</title><meta charset='utf-8'><link rel='canonical' href='%s'><meta name='robots' content='noindex'><meta http-equiv='refresh' content='0; url=%s'></head><body><a href='%s'>%s</a></body></html>`
+
+var redirect_files = map[string]string {
+	"netlify": "_redirects",
+	"nginx":   "redirects.map",
+}
+
+// adds an entry to source for every alias, so
+// compare_files writes them and doesn't take
+// them for orphans
+func alias_pages(source map[string]*File_Info) {
+	ids := make([]string, 0, len(PageList))
+
+	for id, page := range PageList {
+		if page.IsDraft && !config.ShowDrafts {
+			continue
+		}
+		if _, ok := page.Vars["aliases"]; ok {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+
+	taken := make(map[string]bool, len(source))
+
+	for _, f := range source {
+		taken[target(f)] = true
+	}
+
+	for _, id := range ids {
+		page := PageList[id]
+
+		for _, alias := range split_list(page.Vars["aliases"]) {
+			alias_id, ok := url_target(alias)
+
+			if !ok {
+				file_error(page.SourcePath, "alias " + alias + " leaves the output directory")
+				continue
+			}
+
+			out := output_target(alias_id)
+
+			if taken[out] {
+				file_error(page.SourcePath, "alias " + alias + " is already used by another page")
+				continue
+			}
+
+			taken[out] = true
+
+			info := &File_Info{
+				ID:     "alias_" + alias_id,
+				Path:   page.SourcePath,
+				Dir:    filepath.Dir(filepath.FromSlash(out)),
+				Target: out,
+				Format: REDIRECT,
+				Mod:    page.Mod,
+			}
+
+			if f, ok := source[id]; ok {
+				info.Mod = f.Mod
+			}
+
+			source[info.ID]    = info
+			Redirects[info.ID] = page
+		}
+	}
+}
+
+func redirect_url(the_page *Page) string {
+	if the_page.URLPath == "" {
+		return "/"
+	}
+	return the_page.URLPath
+}
+
+func write_redirect(file *File_Info) bool {
+	page := Redirects[file.ID]
+	url  := redirect_url(page)
+
+	return write_output(
+		filepath.Join(config.Output, filepath.FromSlash(file.Target) + ".html"),
+		sub_attr(redirect_source, config.Domain + url, url, url, url),
+	)
+}
+
+// the alias path as the server sees it
+func alias_url(file *File_Info) string {
+	id := strings.TrimPrefix(file.ID, "alias_")
+
+	if id == "index" {
+		return "/"
+	}
+	return url_path(id)
+}
+
+// _redirects or redirects.map, rewritten when
+// its contents change and removed when it is
+// no longer wanted
+func redirect_list(source map[string]*File_Info) {
+	for style, name := range redirect_files {
+		path := filepath.Join(config.Output, name)
+
+		if style != config.Redirects || len(Redirects) == 0 {
+			if file_exists(path) {
+				delete_file(path)
+			}
+			continue
+		}
+
+		list := make([]*File_Info, 0, len(Redirects))
+
+		for id := range Redirects {
+			list = append(list, source[id])
+		}
+
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].ID < list[j].ID
+		})
+
+		var b strings.Builder
+
+		for _, f := range list {
+			from := alias_url(f)
+			to   := redirect_url(Redirects[f.ID])
+
+			switch style {
+				case "netlify": b.WriteString(sub_sprint("%s  %s  301\n", from, to))
+				case "nginx":   b.WriteString(sub_sprint("%s %s;\n", from, to))
+			}
+		}
+
+		if file_exists(path) && string(load_file_bytes(path)) == b.String() {
+			continue
+		}
+
+		write_file(path, b.String())
+	}
+
+	if _, ok := redirect_files[config.Redirects]; !ok && config.Redirects != "" {
+		file_error("_data/oko.json", `unknown redirects style "` + config.Redirects + `", use "netlify" or "nginx"`)
+	}
+}
\ No newline at end of file
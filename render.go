@@ -1,14 +1,13 @@
 package main
 
 import (
-	"os"
 	"sort"
-	"bufio"
+	"sync"
 	"strings"
 	"path/filepath"
 )
 
-func render(p *Page) {
+func assign_plate(p *Page) {
 	if plate_name, ok := p.Vars["plate"]; ok {
 		p.Plate = load_plate(plate_name)
 	} else {
@@ -18,6 +17,24 @@ func render(p *Page) {
 			p.Style = config.Style
 		}
 	}
+}
+
+// the page body alone, without the plate's
+// snippets or the document around it
+func render_content(p *Page) string {
+	assign_plate(p)
+
+	p.List.Reset()
+	content := recurse_render(p, nil)
+	p.List.Reset()
+
+	return mapmap(content, page_vars(p), true)
+}
+
+// reports whether the output was written,
+// which it isn't when nothing changed
+func render(p *Page) bool {
+	assign_plate(p)
 
 	var body strings.Builder
 	var body_inside strings.Builder
@@ -58,7 +75,7 @@ func render(p *Page) {
 	var title   string
 
 	if f, ok := p.Vars["favicon"]; ok {
-		favicon = make_favicon(f)
+		favicon = make_favicon(p.SourcePath, f)
 	} else {
 		favicon = config.Favicon
 	}
@@ -69,28 +86,31 @@ func render(p *Page) {
 		title = config.Title
 	}
 
-	file, err := os.Create(p.OutputPath)
-
-	if err != nil {
-		panic(err)
-	}
-
-	defer file.Close()
-
-	writer := bufio.NewWriter(file)
+	var writer strings.Builder
 
 	writer.WriteString(`<!DOCTYPE html><html><head><title>`)
-	writer.WriteString(title)
+	writer.WriteString(escape_text(title))
 	writer.WriteString(`</title><meta charset='utf-8'>`)
 	writer.WriteString(favicon)
 	writer.WriteString(render_style(p.Style,   p.Plate.StyleRender))
 	writer.WriteString(render_script(p.Script, p.Plate.ScriptRender))
 	writer.WriteString(meta(p))
 	writer.WriteString(`</head><body>`)
-	writer.WriteString(mapmap(body.String(), p.Vars, true))
+	writer.WriteString(mapmap(body.String(), page_vars(p), true))
+
+	if config.Serve {
+		writer.WriteString(reload_script)
+	}
+
 	writer.WriteString(`</body></html>`)
 
-	writer.Flush()
+	updated := write_output(p.OutputPath, writer.String())
+
+	if page_failed(p) {
+		forget_page(p)
+	}
+
+	return updated
 }
 
 func recurse_render(the_page *Page, active_block *Token) string {
@@ -107,21 +127,22 @@ func recurse_render(the_page *Page, active_block *Token) string {
 		}
 
 		if tok.Type > tok_if_statements {
-			if check_if_statement(the_page, tok) {
-				content.WriteString(recurse_render(the_page, tok))
-			} else {
-				skip_block(the_page, tok)
-			}
+			content.WriteString(render_if_chain(the_page, tok))
 			continue
 		}
 
+		// tokens are shared between renders of
+		// the same snippet, so they're only read
+		text := tok.Text
+
 		if tok.Type < tok_inline_format {
-			tok.Text = inlines(tok.Text)
+			text = inlines(text)
 		}
 
 		switch tok.Type {
 			case ERROR:
-				render_error(the_page, tok, "parser error")
+				// reported by parse_errors
+				continue
 
 			case LIST_ENTRY:
 				var list_buffer strings.Builder
@@ -148,8 +169,13 @@ func recurse_render(the_page *Page, active_block *Token) string {
 				if filepath.Ext(tok.Text) == "" {
 					content.WriteString(snippet(the_page, tok.Text))
 				} else {
-					// @todo error
-					content.WriteString(string(load_file_bytes(filepath.Join("_data/snippets", tok.Text))))
+					path := filepath.Join("_data/snippets", tok.Text)
+
+					if file_exists(path) {
+						content.WriteString(string(load_file_bytes(path)))
+					} else {
+						page_error(the_page, tok, "snippet " + tok.Text + " does not exist")
+					}
 				}
 				continue
 
@@ -166,12 +192,12 @@ func recurse_render(the_page *Page, active_block *Token) string {
 
 				if v, ok := plate.Tokens[t]; ok {
 					if p, ok := PageList[n[0]]; ok {
-						content.WriteString(inlines(mapmap(v, p.Vars, true)))
+						content.WriteString(inlines(mapmap(v, page_vars(p), true)))
 					} else {
-						warning("skipped import " + n[0])
+						page_warning(the_page, tok, "skipped import " + n[0])
 					}
 				} else {
-					render_error(the_page, tok, "failed to import")
+					page_error(the_page, tok, "failed to import " + tok.Text + ", no plate token " + t)
 				}
 
 				continue
@@ -183,7 +209,7 @@ func recurse_render(the_page *Page, active_block *Token) string {
 				continue
 
 			case MEDIA:
-				content.WriteString(media(tok.Text))
+				content.WriteString(media(the_page, tok))
 				continue
 
 			case HTML_SNIPPET:
@@ -221,6 +247,10 @@ func recurse_render(the_page *Page, active_block *Token) string {
 				content.WriteString(mapmap(child_content, tok.Vars, false))
 				continue
 
+			case BLOCK_EACH:
+				content.WriteString(render_each(the_page, tok))
+				continue
+
 			case BLOCK_CLOSE:
 				return content.String()
 		}
@@ -234,8 +264,8 @@ func recurse_render(the_page *Page, active_block *Token) string {
 		}
 
 		if tok.Type == HEADING {
-			clean_text := strip_inlines(tok.Text)
-			dirty_text := inlines(tok.Text)
+			clean_text := strip_inlines(text)
+			dirty_text := inlines(text)
 
 			content.WriteString(sub_sprint(p, make_element_id(clean_text), dirty_text))
 			continue
@@ -246,12 +276,56 @@ func recurse_render(the_page *Page, active_block *Token) string {
 			continue
 		}
 
-		content.WriteString(sub_content(p, tok.Text))
+		content.WriteString(sub_content(p, text))
 	}
 
 	return content.String()
 }
 
+// renders exactly one branch of an if, else if
+// and else chain, skipping all of the others
+func render_if_chain(the_page *Page, tok *Token) string {
+	the_list := the_page.List
+
+	taken   := false
+	content := ""
+
+	for {
+		if !taken && check_if_statement(the_page, tok) {
+			content = recurse_render(the_page, tok)
+			taken   = true
+		} else {
+			skip_block(the_page, tok)
+		}
+
+		next := the_list.Lookahead()
+
+		if next == nil {
+			break
+		}
+
+		if next.Type == ELSE_IF {
+			the_list.Next()
+			tok = the_list.Next()
+			continue
+		}
+
+		if next.Type == ELSE {
+			the_list.Next()
+
+			if !taken {
+				content = recurse_render(the_page, next)
+			} else {
+				skip_block(the_page, next)
+			}
+		}
+
+		break
+	}
+
+	return content
+}
+
 func skip_block(the_page *Page, active_block *Token) {
 	the_list := the_page.List
 
@@ -267,7 +341,7 @@ func skip_block(the_page *Page, active_block *Token) {
 			continue
 		}
 
-		if tok.Type == BLOCK_START {
+		if tok.Type == BLOCK_START || tok.Type == BLOCK_EACH || tok.Type == ELSE {
 			skip_block(the_page, active_block)
 			continue
 		}
@@ -282,34 +356,72 @@ func skip_block(the_page *Page, active_block *Token) {
 //
 // Snippets
 //
-var SnippetText = make(map[string]string)
-var SnippetList = make(map[string]*Page)
+// a snippet is parsed once per build; one that
+// doesn't depend on the page using it is also
+// rendered just once and its text reused
+type Snippet struct {
+	once sync.Once
+
+	page      *Page
+	text      string
+	committed bool
+}
+
+var Snippets = make(map[string]*Snippet)
+
+var snippet_mutex sync.Mutex
 
 func snippet(parent *Page, name string) string {
-	if body, ok := SnippetText[name]; ok {
-		return body
+	snippet_mutex.Lock()
+
+	s, ok := Snippets[name]
+
+	if !ok {
+		s = &Snippet{}
+		Snippets[name] = s
 	}
-	if saved_page, ok := SnippetList[name]; ok {
-		saved_page.List.Reset()
-		saved_page.CurrentParent = parent
-		return render_snippet(saved_page)
+
+	snippet_mutex.Unlock()
+
+	s.once.Do(func() {
+		load_snippet(s, parent, name)
+	})
+
+	if s.committed || s.page == nil {
+		return s.text
 	}
 
+	// pages using the same snippet render at the
+	// same time, so each render gets its own
+	// cursor and parent over the shared tokens
+	the_page := *s.page
+
+	the_page.List = &Token_List{Tokens: s.page.List.Tokens}
+	the_page.CurrentParent = parent
+
+	return render_snippet(&the_page)
+}
+
+func load_snippet(s *Snippet, parent *Page, name string) {
 	path := filepath.Join("_data/snippets", name + ".ø")
-	the_page := &Page{}
+	the_page := &Page{SourcePath: path}
 
-	the_page.Vars = make(map[string]string)
+	the_page.Vars  = make(map[string]string)
+	the_page.Meta  = make(map[string]string)
+	the_page.Typed = make(map[string]*Value)
 	the_page.CurrentParent = parent
 
 	if !file_exists(path) {
 		warning("snippet " + name + " does not exist")
-		return ""
+		return
 	}
 
 	the_page.List = parser(the_page, load_file_bytes(path))
 
+	parse_errors(the_page, the_page.List)
+
 	if the_page.IsDraft {
-		warning("cannot have draft snippet " + the_page.ID)
+		file_error(path, "cannot have draft snippet " + name)
 	}
 
 	if plate_name, ok := the_page.Vars["plate"]; ok {
@@ -318,15 +430,13 @@ func snippet(parent *Page, name string) string {
 		the_page.Plate = default_plate
 	}
 
-	b := render_snippet(the_page)
-
 	if the_page.List.IsCommittable {
-		SnippetText[name] = b
-	} else {
-		SnippetList[name] = the_page
+		s.text      = render_snippet(the_page)
+		s.committed = true
+		return
 	}
 
-	return b
+	s.page = the_page
 }
 
 func render_snippet(p *Page) string {
@@ -384,29 +494,47 @@ var meta_descrip = `<meta name='description' content='%s'>`
 func meta(the_page *Page) string {
 	var meta_block strings.Builder
 
-	if _, ok := the_page.Meta["title"]; !ok {
-		the_page.Meta["title"] = the_page.Vars["title"]
+	// other pages may be reading this one, so
+	// the defaults go into a copy
+	page_meta := make(map[string]string, len(the_page.Meta) + 3)
+
+	for k, v := range the_page.Meta {
+		page_meta[k] = v
+	}
+
+	if _, ok := page_meta["title"]; !ok {
+		page_meta["title"] = the_page.Vars["title"]
 	}
-	if _, ok := the_page.Meta["description"]; !ok {
+	if _, ok := page_meta["description"]; !ok {
 		if v, ok := config.Meta["description"]; ok {
-			the_page.Meta["description"] = v
+			page_meta["description"] = v
 		}
 	}
-	if _, ok := the_page.Meta["image"]; !ok {
+	if _, ok := page_meta["image"]; !ok {
 		if v, ok := config.Meta["image"]; ok {
-			the_page.Meta["image"] = v
+			page_meta["image"] = v
 		}
 	}
 
+	tags := make([]string, 0, len(page_meta))
+
+	for tag := range page_meta {
+		tags = append(tags, tag)
+	}
+
+	sort.Strings(tags)
+
 	// domain
 	canon_path := config.Domain + the_page.URLPath
-	meta_block.WriteString(sub_content(`<link rel='canonical' href='%s'>`, canon_path))
-	meta_block.WriteString(sub_sprint(meta_source, "og:url", canon_path))
+	meta_block.WriteString(sub_attr(`<link rel='canonical' href='%s'>`, canon_path))
+	meta_block.WriteString(sub_attr(meta_source, "og:url", canon_path))
 
 	domain := check_slash(config.Domain)
 
 	// generic opengraph entries
-	for tag, value := range the_page.Meta {
+	for _, tag := range tags {
+		value := page_meta[tag]
+
 		switch tag {
 			case "image":
 				if strings.HasPrefix(value, "/") {
@@ -416,10 +544,10 @@ func meta(the_page *Page) string {
 				}
 
 			case "description":
-				meta_block.WriteString(sub(meta_descrip, "v", value))
+				meta_block.WriteString(sub_attr(meta_descrip, value))
 		}
 
-		meta_block.WriteString(sub_sprint(meta_source, "og:" + tag, value))
+		meta_block.WriteString(sub_attr(meta_source, "og:" + tag, value))
 	}
 
 	// twitter
@@ -441,12 +569,12 @@ func meta(the_page *Page) string {
 	}
 
 	if twitter_creator != "" {
-		meta_block.WriteString(sub_sprint(meta_source, "twitter:creator", twitter_creator))
+		meta_block.WriteString(sub_attr(meta_source, "twitter:creator", twitter_creator))
 		needs_media_card = true
 	}
 
 	if twitter_site != "" {
-		meta_block.WriteString(sub_sprint(meta_source, "twitter:site", twitter_site))
+		meta_block.WriteString(sub_attr(meta_source, "twitter:site", twitter_site))
 		needs_media_card = true
 	}
 
@@ -455,37 +583,4 @@ func meta(the_page *Page) string {
 	}
 
 	return meta_block.String()
-}
-
-func sitemap(path string) {
-	ordered    := make([]string, len(PageList))
-	url_source := `<url><loc>%s%s</loc></url>`
-
-	for _, page := range PageList {
-		ordered = append(ordered, sub_sprint(url_source, config.Domain, page.URLPath))
-	}
-
-	sort.SliceStable(ordered, func(i, j int) bool {
-		return ordered[i] < ordered[j]
-	})
-
-	file, err := os.Create(path)
-
-	if err != nil {
-		panic(err)
-	}
-
-	defer file.Close()
-
-	writer := bufio.NewWriter(file)
-
-	writer.WriteString(`<?xml version="1.0" encoding="utf-8" standalone="yes"?><urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9" xmlns:xhtml="http://www.w3.org/1999/xhtml">`)
-
-	for _, page := range ordered {
-		writer.WriteString(page)
-	}
-
-	writer.WriteString(`</urlset>`)
-
-	writer.Flush()
 }
\ No newline at end of file
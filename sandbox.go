@@ -0,0 +1,369 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"time"
+	"reflect"
+	"strings"
+	"io/ioutil"
+	"path/filepath"
+	"github.com/robertkrimen/otto"
+)
+
+// "functions": {
+//     "timeout": 10000,
+//     "max_steps": 10000000,
+//     "stack_limit": 200
+// }
+//
+// timeout is in milliseconds per call and
+// defaults to ten seconds; max_steps caps the
+// statements and expressions one call may
+// evaluate and stack_limit caps recursion,
+// both are off unless set
+type Function_Config struct {
+	Timeout    int
+	MaxSteps   int `json:"max_steps"`
+	StackLimit int `json:"stack_limit"`
+}
+
+const default_function_timeout = 10000
+
+// steps between looking at the clock
+const guard_interval = 1024
+
+// why a script was stopped and where it was
+type Script_Halt struct {
+	Reason string
+	Stack  []string
+}
+
+func (h *Script_Halt) Error() string {
+	if len(h.Stack) == 0 {
+		return h.Reason
+	}
+	return h.Reason + "\n    at " + strings.Join(h.Stack, "\n    at ")
+}
+
+// runs a compiled script under the limits in
+// config.Functions; a script that runs too
+// long is stopped where it is and comes back
+// as an error, while a panic anywhere else is
+// a bug in oko and still takes the build down
+//
+// otto runs whatever is waiting on Interrupt
+// before each statement and expression, so a
+// guard that puts itself back every time sees
+// every step of this script and no other
+func run_script(vm *otto.Otto, script *Compiled_Script) (err error) {
+	limits := config.Functions
+
+	if limits.StackLimit > 0 {
+		vm.SetStackDepthLimit(limits.StackLimit)
+	}
+
+	timeout := time.Duration(limits.Timeout) * time.Millisecond
+	start   := time.Now()
+	steps   := 0
+
+	// otto recovers every panic inside a try,
+	// so a script can catch its own halt; once
+	// stopped, the guard stays armed and halts
+	// again on every step until the script
+	// gives up, and the halt is kept here for
+	// whatever error otto hands back
+	var stopped *Script_Halt
+
+	halt := func(reason string) {
+		stopped = &Script_Halt{reason, script_stack(vm, script.Path)}
+	}
+
+	var guard func()
+
+	guard = func() {
+		steps++
+
+		if stopped == nil {
+			if limits.MaxSteps > 0 && steps > limits.MaxSteps {
+				halt(fmt.Sprintf("went over the limit of %d steps", limits.MaxSteps))
+
+			} else if steps % guard_interval == 0 && time.Since(start) > timeout {
+				halt(fmt.Sprintf("timed out after %s", timeout))
+			}
+		}
+
+		vm.Interrupt <- guard
+
+		if stopped != nil {
+			panic(stopped)
+		}
+	}
+
+	vm.Interrupt = make(chan func(), 1)
+	vm.Interrupt <- guard
+
+	defer func() {
+		r := recover()
+
+		if r != nil {
+			if _, ok := r.(*Script_Halt); !ok {
+				panic(r)
+			}
+		}
+		if stopped != nil {
+			err = stopped
+		}
+	}()
+
+	_, err = vm.Run(script.Script)
+
+	return err
+}
+
+// otto only knows where a frame is once it
+// has made a call, and never for the top of a
+// script, so a loop with no calls in it shows
+// as <unknown>; those frames get the script's
+// path instead, which at least names the file
+func script_stack(vm *otto.Otto, path string) []string {
+	stack := vm.Context().Stacktrace
+
+	if len(stack) == 0 {
+		return []string{path}
+	}
+
+	for i, frame := range stack {
+		stack[i] = strings.Replace(frame, "<unknown>", path, 1)
+	}
+
+	return stack
+}
+
+//
+// copies
+//
+
+// scripts get copies of everything they are
+// shown, so nothing they do reaches the build
+// or the other scripts running beside them
+func js_copy(v interface{}) interface{} {
+	return plain_value(reflect.ValueOf(v))
+}
+
+func plain_value(v reflect.Value) interface{} {
+	switch v.Kind() {
+		case reflect.Invalid:
+			return nil
+
+		case reflect.Ptr, reflect.Interface:
+			if v.IsNil() {
+				return nil
+			}
+			return plain_value(v.Elem())
+
+		case reflect.Struct:
+			if t, ok := v.Interface().(time.Time); ok {
+				return t
+			}
+
+			m := make(map[string]interface{}, v.NumField())
+
+			for i := 0; i < v.NumField(); i++ {
+				if f := v.Type().Field(i); f.PkgPath == "" {
+					m[f.Name] = plain_value(v.Field(i))
+				}
+			}
+			return m
+
+		case reflect.Map:
+			m := make(map[string]interface{}, v.Len())
+
+			for _, k := range v.MapKeys() {
+				m[fmt.Sprint(k.Interface())] = plain_value(v.MapIndex(k))
+			}
+			return m
+
+		case reflect.Slice, reflect.Array:
+			if v.Kind() == reflect.Slice && v.IsNil() {
+				return []interface{}{}
+			}
+
+			list := make([]interface{}, v.Len())
+
+			for i := range list {
+				list[i] = plain_value(v.Index(i))
+			}
+			return list
+	}
+
+	return v.Interface()
+}
+
+// a page as get_page returns it; the plate,
+// parent and parse state stay behind
+func js_page(p *Page) interface{} {
+	return js_copy(map[string]interface{}{
+		"ID":         p.ID,
+		"SourcePath": p.SourcePath,
+		"OutputPath": p.OutputPath,
+		"URLPath":    p.URLPath,
+		"Origin":     p.Origin,
+		"IsDraft":    p.IsDraft,
+		"Mod":        p.Mod,
+		"Style":      p.Style,
+		"Script":     p.Script,
+		"Vars":       p.Vars,
+		"Meta":       p.Meta,
+		"Tokens":     p.List.Tokens,
+	})
+}
+
+// only the data files a script mentions are
+// copied in, see function_data_files
+func js_data(source string) interface{} {
+	data := make(map[string]interface{})
+
+	for _, name := range function_data_files(source) {
+		data[name] = Data[name]
+	}
+
+	return js_copy(data)
+}
+
+//
+// files
+//
+
+// the path inside the project a script asked
+// for; absolute paths, paths out of the
+// project and links pointing out of it are
+// refused
+func project_path(path string) (string, bool) {
+	if path == "" || filepath.IsAbs(path) {
+		return "", false
+	}
+
+	clean := filepath.Clean(filepath.FromSlash(path))
+
+	if clean == ".." || strings.HasPrefix(clean, ".." + string(filepath.Separator)) {
+		return "", false
+	}
+
+	root, err := filepath.Abs(".")
+
+	if err != nil {
+		return "", false
+	}
+
+	real, err := filepath.EvalSymlinks(clean)
+
+	if err != nil {
+		return "", false
+	}
+
+	real, err = filepath.Abs(real)
+
+	if err != nil {
+		return "", false
+	}
+
+	if real != root && !strings.HasPrefix(real, root + string(filepath.Separator)) {
+		return "", false
+	}
+
+	return clean, true
+}
+
+// read_file(path) and list_files(dir) are all
+// a function can see of the disk; what they
+// return is recorded as an input, so the
+// cached result is dropped and the page
+// rendered again when the file changes
+func js_files(vm *otto.Otto, record *Function_Record) {
+	vm.Set("read_file", func(call otto.FunctionCall) otto.Value {
+		arg := call.Argument(0).String()
+
+		record.Inputs["file:" + arg] = function_input("file:" + arg, nil, nil)
+
+		text, ok := read_project_file(arg)
+
+		if !ok {
+			return otto.UndefinedValue()
+		}
+
+		value, _ := vm.ToValue(text)
+		return value
+	})
+
+	vm.Set("list_files", func(call otto.FunctionCall) otto.Value {
+		arg := call.Argument(0).String()
+
+		record.Inputs["dir:" + arg] = function_input("dir:" + arg, nil, nil)
+
+		names, ok := list_project_dir(arg)
+
+		if !ok {
+			return otto.UndefinedValue()
+		}
+
+		list, _ := vm.Object(`[]`)
+
+		for _, n := range names {
+			list.Call("push", n)
+		}
+		return list.Value()
+	})
+}
+
+func read_project_file(path string) (string, bool) {
+	clean, ok := project_path(path)
+
+	if !ok || !file_exists(clean) {
+		return "", false
+	}
+
+	b, err := ioutil.ReadFile(clean)
+
+	if err != nil {
+		return "", false
+	}
+
+	return string(b), true
+}
+
+// names in a directory, sorted, with a slash
+// after directories
+func list_project_dir(path string) ([]string, bool) {
+	clean, ok := project_path(path)
+
+	if !ok || !path_exists(clean) {
+		return nil, false
+	}
+
+	list, err := ioutil.ReadDir(clean)
+
+	if err != nil {
+		return nil, false
+	}
+
+	names := make([]string, 0, len(list))
+
+	for _, info := range list {
+		name := info.Name()
+
+		if info.Mode() & os.ModeSymlink != 0 {
+			continue
+		}
+		if info.IsDir() {
+			name += "/"
+		}
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names, true
+}
\ No newline at end of file
@@ -1,53 +1,201 @@
 package main
 
 import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"strings"
 	"path/filepath"
 	"github.com/robertkrimen/otto"
 )
 
 var secondary_renders = make(map[string]*Page)
 
+// the output of a page's functions, held back
+// until every page has run so that functions
+// reading other pages see them unchanged
+type Function_Result struct {
+	Text map[*Token]string
+	Vars map[string]string
+}
+
+// "recent_posts limit=5 section='my blog'" ->
+// "recent_posts", {limit: 5, section: my blog}
+func parse_function_args(text string) (string, map[string]string, error) {
+	parts := split_quoted(strings.TrimSpace(text), ' ')
+	name  := parts[0]
+
+	if len(parts) == 1 {
+		return name, nil, nil
+	}
+
+	args := make(map[string]string, len(parts) - 1)
+
+	for _, a := range parts[1:] {
+		if a == "" {
+			continue
+		}
+
+		kv := strings.SplitN(a, "=", 2)
+
+		if len(kv) != 2 || kv[0] == "" {
+			return name, args, fmt.Errorf(`function "%s": argument %s is not name=value`, name, a)
+		}
+
+		args[kv[0]] = unquote_arg(kv[1])
+	}
+
+	return name, args, nil
+}
+
+// "name k=v ..." with the arguments sorted,
+// so the same call always reads the same
+func function_call(tok *Token) string {
+	keys := make([]string, 0, len(tok.Vars))
+
+	for k := range tok.Vars {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	call := tok.Text
+
+	for _, k := range keys {
+		call += fmt.Sprintf(" %s=%q", k, tok.Vars[k])
+	}
+
+	return call
+}
+
 func do_functions(page *Page) {
+	apply_functions(page, run_functions(page))
+}
+
+// runs every function on a page in order; the
+// vars they assign are visible to the ones
+// after them but only land in page.Vars once
+// apply_functions is called
+func run_functions(page *Page) *Function_Result {
+	result := &Function_Result{
+		Text: make(map[*Token]string),
+		Vars: make(map[string]string),
+	}
+
+	n := 0
+
 	for _, f := range page.List.Tokens {
 		if f.Type == FUNCTION {
-			f.Text = do_single_function(page, f.Text)
+			key := fmt.Sprintf("%s#%d %s", page.ID, n, function_call(f))
+			n++
+
+			result.Text[f] = do_single_function(page, f, result.Vars, key)
 		}
 	}
+
+	return result
 }
 
-func do_single_function(page *Page, name string) string {
+func apply_functions(page *Page, result *Function_Result) {
+	for tok, text := range result.Text {
+		tok.Text = text
+	}
+	for k, v := range result.Vars {
+		page.Vars[k] = v
+	}
+}
+
+func do_single_function(page *Page, tok *Token, pending map[string]string, key string) string {
+	name := tok.Text
 	path := filepath.Join("_data/functions", name + ".js")
 
 	if !file_exists(path) {
-		warning(page.ID + `: external function "` + name + `" does not exist`)
+		page_warning(page, tok, `external function "` + name + `" does not exist`)
 		return ""
 	}
 
-	file := string(load_file_bytes(path))
+	script := load_script(path)
+
+	function_data_dependencies(page, script.Source)
+
+	// a call whose script and inputs are what
+	// they were last time returns what it
+	// returned then without running
+	if record := cached_function(key, script, page, pending); record != nil {
+		for input := range record.Inputs {
+			if id := strings.TrimPrefix(input, "page:"); id != input && PageList[id] != nil {
+				add_dependency(page.ID, id)
+			}
+		}
+		for k, v := range record.Vars {
+			pending[k] = v
+		}
+
+		store_function(page, key, record)
+
+		return record.Result
+	}
+
+	if script.Err != nil {
+		page_error(page, tok, `function "` + name + `" failed: ` + script_error(script.Err))
+		return ""
+	}
+
+	record := &Function_Record{
+		Script: script.Hash,
+		Inputs: make(map[string]string),
+		Vars:   make(map[string]string),
+	}
+
+	for _, input := range []string{"self", "project"} {
+		record.Inputs[input] = function_input(input, page, pending)
+	}
+	for _, name := range function_data_files(script.Source) {
+		record.Inputs["data:" + name] = DataHashes[name]
+	}
 
 	// new js instance
 	vm := otto.New()
 
 	// register current page data into instance
+	vars, set := js_vars(vm, page, pending)
+
 	page_data, _ := vm.Object(`page = {}`)
-	page_data.Set("Vars",   page.Vars)
-	page_data.Set("Tokens", page.List.Tokens)
+	page_data.Set("Vars",   vars)
+	page_data.Set("Tokens", js_copy(page.List.Tokens))
+
+	// register the call's arguments
+	js_args, _ := vm.Object(`({})`)
+
+	for k, v := range tok.Vars {
+		js_args.Set(k, js_value(vm, parse_value(k, v)))
+	}
+
+	vm.Set("args", js_args)
 
 	// register project data into instance
-	vm.Set("project", config)
+	vm.Set("project", js_copy(config))
+	vm.Set("data",    js_data(script.Source))
+
+	js_files(vm, record)
 
 	// register page_list
 	vm.Set("get_page", func(call otto.FunctionCall) otto.Value {
 		id := call.Argument(0).String()
 
+		// pages that don't exist are inputs too,
+		// in case they turn up later
+		record.Inputs["page:" + id] = function_input("page:" + id, page, pending)
+
 		if p, ok := PageList[id]; ok {
-			js_p, err := vm.ToValue(p)
+			js_p, err := vm.ToValue(js_page(p))
 
 			if err != nil {
-				panic(err)
+				return otto.Value{}
 			}
 
-			DepTree[page.ID] = append(DepTree[page.ID], id)
+			add_dependency(page.ID, id)
 
 			return js_p
 		}
@@ -63,23 +211,298 @@ func do_single_function(page *Page, name string) string {
 	}
 
 	// execute instance
-	_, err := vm.Run(file)
+	err := run_script(vm, script)
 
 	if err != nil {
-		panic(err)
+		page_error(page, tok, `function "` + name + `" on ` + page.ID + ` failed: ` + script_error(err))
+		return ""
+	}
+
+	sync_vars(record.Vars, vars, set)
+
+	for k, v := range record.Vars {
+		pending[k] = v
 	}
 
 	value, err := vm.Get("result")
 
 	if err != nil {
-		panic(err)
+		page_error(page, tok, `function "` + name + `" failed: ` + err.Error())
+		return ""
 	}
 
+	// failed calls aren't cached, so they run
+	// and report again next time
+	record.Result = js_result(value)
+
+	store_function(page, key, record)
+
+	return record.Result
+}
+
+func js_result(value otto.Value) string {
 	str, _ := value.Export() // this err is always nil in otto
 
 	if str == nil {
 		return ""
 	}
 
-	return str.(string)
+	if s, ok := str.(string); ok {
+		return s
+	}
+
+	return value.String()
+}
+
+// otto errors carry the JS stack
+func script_error(err error) string {
+	if js_err, ok := err.(*otto.Error); ok {
+		return strings.TrimSpace(js_err.String())
+	}
+	return err.Error()
+}
+
+//
+// compiled scripts
+//
+type Compiled_Script struct {
+	Path   string
+	Hash   string
+	Source string
+	Script *otto.Script
+	Err    error
+}
+
+// scripts are compiled once and rerun in
+// every vm that needs them, until their
+// content changes
+var ScriptList = make(map[string]*Compiled_Script)
+
+var script_mutex sync.Mutex
+
+func load_script(path string) *Compiled_Script {
+	source := string(load_file_bytes(path))
+	hash   := hash_text(source)
+
+	script_mutex.Lock()
+	defer script_mutex.Unlock()
+
+	if s, ok := ScriptList[path]; ok && s.Hash == hash {
+		return s
+	}
+
+	s := &Compiled_Script{Path: path, Hash: hash, Source: source}
+
+	s.Script, s.Err = otto.New().Compile(path, source)
+
+	ScriptList[path] = s
+
+	return s
+}
+
+//
+// cached results
+//
+type Function_Record struct {
+	Script string            `json:"script"`
+	Inputs map[string]string `json:"inputs"`
+	Result string            `json:"result"`
+	Vars   map[string]string `json:"vars"`
+}
+
+func cached_function(key string, script *Compiled_Script, page *Page, pending map[string]string) *Function_Record {
+	record, ok := LastBuild.Functions[key]
+
+	if !ok || record.Script != script.Hash || script.Err != nil {
+		return nil
+	}
+
+	for input, hash := range record.Inputs {
+		if function_input(input, page, pending) != hash {
+			return nil
+		}
+	}
+
+	return record
+}
+
+// pages whose functions returned something
+// other than last time, which have to be
+// rendered again even if nothing else changed
+var FunctionChanged = make(map[string]bool)
+
+func store_function(page *Page, key string, record *Function_Record) {
+	manifest_mutex.Lock()
+	defer manifest_mutex.Unlock()
+
+	NextBuild.Functions[key] = record
+
+	if !same_result(LastBuild.Functions[key], record) {
+		FunctionChanged[page.ID] = true
+	}
+}
+
+func same_result(a, b *Function_Record) bool {
+	if a == nil || a.Result != b.Result || len(a.Vars) != len(b.Vars) {
+		return false
+	}
+	for k, v := range a.Vars {
+		if b.Vars[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// the current value of something a function
+// read: its own page, the project, another
+// page, a data file or a file in the project
+func function_input(input string, page *Page, pending map[string]string) string {
+	switch {
+		case input == "self":
+			return page_fingerprint(page, pending)
+
+		case input == "project":
+			return NextBuild.Build
+
+		case strings.HasPrefix(input, "page:"):
+			if p, ok := PageList[input[5:]]; ok {
+				return page_fingerprint(p, nil)
+			}
+			return ""
+
+		case strings.HasPrefix(input, "data:"):
+			return DataHashes[input[5:]]
+
+		case strings.HasPrefix(input, "file:"):
+			if text, ok := read_project_file(input[5:]); ok {
+				return hash_text(text)
+			}
+			return ""
+
+		case strings.HasPrefix(input, "dir:"):
+			if names, ok := list_project_dir(input[4:]); ok {
+				return hash_text(strings.Join(names, "\n"))
+			}
+			return ""
+	}
+
+	return ""
+}
+
+// a page as a function sees it, its vars and
+// tokens, without anything time dependent
+func page_fingerprint(page *Page, pending map[string]string) string {
+	var b strings.Builder
+
+	write_map := func(m map[string]string) {
+		keys := make([]string, 0, len(m))
+
+		for k := range m {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			fmt.Fprintf(&b, "%q=%q\n", k, m[k])
+		}
+	}
+
+	vars := make(map[string]string, len(page.Vars) + len(pending))
+
+	for k, v := range page.Vars {
+		vars[k] = v
+	}
+	for k, v := range pending {
+		vars[k] = v
+	}
+
+	b.WriteString(page.ID + "\n")
+	write_map(vars)
+
+	for _, tok := range page.List.Tokens {
+		fmt.Fprintf(&b, "%d %q\n", tok.Type, tok.Text)
+		write_map(tok.Vars)
+	}
+
+	return hash_text(b.String())
+}
+
+// a typed value as javascript sees it:
+// numbers, arrays and Date objects
+func js_value(vm *otto.Otto, v *Value) interface{} {
+	switch v.Type {
+		case V_DATE:
+			date, err := vm.Run(fmt.Sprintf("new Date(%d)", v.Date.UnixNano() / int64(time.Millisecond)))
+
+			if err == nil {
+				return date
+			}
+
+		case V_LIST:
+			list, _ := vm.Object(`[]`)
+
+			for _, item := range v.List {
+				list.Call("push", item)
+			}
+			return list
+
+		case V_INT:
+			return v.Int
+
+		case V_FLOAT:
+			return v.Float
+	}
+
+	return v.Text
+}
+
+// page.Vars as javascript sees it, with any
+// pending changes on top; set records the text
+// of every plain value so changes can be
+// written back
+func js_vars(vm *otto.Otto, page *Page, pending map[string]string) (*otto.Object, map[string]string) {
+	vars, _ := vm.Object(`({})`)
+	set     := make(map[string]string, len(page.Vars) + len(pending))
+
+	set_var := func(k string, v *Value) {
+		vars.Set(k, js_value(vm, v))
+
+		if v.Type != V_DATE && v.Type != V_LIST {
+			value, _ := vars.Get(k)
+			set[k] = value.String()
+		}
+	}
+
+	for k := range page.Vars {
+		if _, ok := pending[k]; !ok {
+			set_var(k, typed_var(page, k))
+		}
+	}
+	for k, v := range pending {
+		set_var(k, parse_value(k, v))
+	}
+
+	return vars, set
+}
+
+// functions may still assign plain values to
+// page.Vars, which later tokens can use
+func sync_vars(pending map[string]string, vars *otto.Object, set map[string]string) {
+	for _, k := range vars.Keys() {
+		value, err := vars.Get(k)
+
+		if err != nil || !value.IsPrimitive() || value.IsUndefined() || value.IsNull() {
+			continue
+		}
+
+		text := value.String()
+
+		if old, ok := set[k]; ok && old == text {
+			continue
+		}
+
+		pending[k] = text
+	}
 }
\ No newline at end of file
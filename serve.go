@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"path"
+	"strings"
+	"net/http"
+	"path/filepath"
+)
+
+// dropped into config.Output while serving so
+// the next regular build knows every page still
+// carries the reload script and rebuilds it
+const serve_marker = ".oko-serve"
+
+var reload_script = `<script>new EventSource('/_oko/reload').onmessage = function() { location.reload() }</script>`
+
+var reload_lock    sync.Mutex
+var reload_clients = make(map[chan bool]bool)
+
+// tells every connected browser to reload
+func reload_browsers() {
+	reload_lock.Lock()
+	defer reload_lock.Unlock()
+
+	for c := range reload_clients {
+		select {
+			case c <- true:
+			default:
+		}
+	}
+}
+
+func serve_reload(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type",  "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection",    "keep-alive")
+
+	flusher.Flush()
+
+	c := make(chan bool, 1)
+
+	reload_lock.Lock()
+	reload_clients[c] = true
+	reload_lock.Unlock()
+
+	defer func() {
+		reload_lock.Lock()
+		delete(reload_clients, c)
+		reload_lock.Unlock()
+	}()
+
+	for {
+		select {
+			case <-c:
+				fmt.Fprint(w, "data: reload\n\n")
+				flusher.Flush()
+
+			case <-r.Context().Done():
+				return
+		}
+	}
+}
+
+// maps clean urls back onto output files the
+// same way make_page builds URLPath, so /blog/post
+// is blog/post.html and /blog is blog/index.html
+func serve_path(output, url_path string) (string, bool) {
+	clean := strings.TrimPrefix(path.Clean("/" + url_path), "/")
+	base  := filepath.Join(output, filepath.FromSlash(clean))
+
+	if clean == "" {
+		base = filepath.Join(output, "index")
+	}
+
+	candidates := []string{
+		base + ".html",
+		filepath.Join(base, "index.html"),
+		base,
+	}
+
+	for _, c := range candidates {
+		if file_exists(c) {
+			return c, true
+		}
+	}
+
+	return "", false
+}
+
+// the watcher swaps config out while requests
+// are being served, so the handler keeps the
+// output directory the server started with
+func serve_file(output string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serve_output(w, r, output)
+	}
+}
+
+func serve_output(w http.ResponseWriter, r *http.Request, output string) {
+	file_path, ok := serve_path(output, r.URL.Path)
+
+	if !ok {
+		not_found := filepath.Join(output, "404.html")
+
+		if !file_exists(not_found) {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(load_file_bytes(not_found))
+		return
+	}
+
+	file, err := os.Open(file_path)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// output is read once, before the watcher
+// starts; a new output in _data/oko.json is
+// served after a restart
+func do_serve(address, output string) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/_oko/reload", serve_reload)
+	mux.HandleFunc("/",            serve_file(output))
+
+	fmt.Printf("[ø] serving %s at http://%s\n\n", output, address)
+
+	err := http.ListenAndServe(address, mux)
+
+	if err != nil {
+		fmt.Println("[ø] server stopped:", err)
+		os.Exit(EXIT_INTERNAL)
+	}
+}
\ No newline at end of file
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"path/filepath"
+)
+
+// the protocol caps a single sitemap at 50,000
+// urls, past that they are split across
+// sitemap-1.xml, sitemap-2.xml... and
+// sitemap.xml becomes the index
+const sitemap_limit = 50000
+
+const sitemap_head  = `<?xml version="1.0" encoding="utf-8" standalone="yes"?>`
+const sitemap_entry = `<url><loc>%s</loc><lastmod>%s</lastmod></url>`
+const sitemap_part  = `<sitemap><loc>%s</loc></sitemap>`
+
+// drafts never go into the sitemap, nor do pages
+// that opt out with "sitemap: false", "noindex"
+// or a noindex robots meta tag
+func sitemap_excluded(the_page *Page) bool {
+	if the_page.IsDraft {
+		return true
+	}
+	if the_page.Vars["sitemap"] == "false" {
+		return true
+	}
+	if v, ok := the_page.Vars["noindex"]; ok && v != "false" {
+		return true
+	}
+	return strings.Contains(the_page.Meta["robots"], "noindex")
+}
+
+// a page's date var if it has one, otherwise
+// when its source was last modified
+func sitemap_lastmod(the_page *Page) string {
+	if t, ok := parse_date(the_page.Vars["date"]); ok {
+		if len(strings.TrimSpace(the_page.Vars["date"])) == len("2006-01-02") {
+			return t.Format("2006-01-02")
+		}
+		return t.Format("2006-01-02T15:04:05Z07:00")
+	}
+	return the_page.Mod.UTC().Format("2006-01-02T15:04:05Z07:00")
+}
+
+func sitemap_part_name(n int) string {
+	return "sitemap-" + strconv.Itoa(n) + ".xml"
+}
+
+func sitemap(dir string) {
+	ordered := make([]*Page, 0, len(PageList))
+
+	for _, page := range PageList {
+		if sitemap_excluded(page) {
+			continue
+		}
+		ordered = append(ordered, page)
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].URLPath < ordered[j].URLPath
+	})
+
+	urlset := func(pages []*Page) string {
+		var b strings.Builder
+
+		b.WriteString(sitemap_head)
+		b.WriteString(`<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9" xmlns:xhtml="http://www.w3.org/1999/xhtml">`)
+
+		for _, page := range pages {
+			b.WriteString(sub_sprint(sitemap_entry, xml_escape(config.Domain + page.URLPath), sitemap_lastmod(page)))
+		}
+
+		b.WriteString(`</urlset>`)
+
+		return b.String()
+	}
+
+	parts := 0
+
+	if len(ordered) <= sitemap_limit {
+		write_file(filepath.Join(dir, `sitemap.xml`), urlset(ordered))
+
+	} else {
+		var index strings.Builder
+
+		index.WriteString(sitemap_head)
+		index.WriteString(`<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">`)
+
+		for start := 0; start < len(ordered); start += sitemap_limit {
+			end := start + sitemap_limit
+
+			if end > len(ordered) {
+				end = len(ordered)
+			}
+
+			parts++
+			name := sitemap_part_name(parts)
+
+			write_file(filepath.Join(dir, name), urlset(ordered[start:end]))
+			index.WriteString(sub_content(sitemap_part, xml_escape(config.Domain + "/" + name)))
+		}
+
+		index.WriteString(`</sitemapindex>`)
+
+		write_file(filepath.Join(dir, `sitemap.xml`), index.String())
+	}
+
+	delete_sitemap_parts(dir, parts + 1)
+}
+
+// removes sitemap-n.xml onwards, left over
+// from a bigger site or a disabled sitemap
+func delete_sitemap_parts(dir string, n int) {
+	for {
+		path := filepath.Join(dir, sitemap_part_name(n))
+
+		if !file_exists(path) {
+			return
+		}
+
+		delete_file(path)
+		n++
+	}
+}
\ No newline at end of file
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sync"
 	"bytes"
 	"bufio"
 	"regexp"
@@ -10,6 +11,8 @@ import (
 
 var SyntaxList = make(map[string]*Highlighter)
 
+var syntax_mutex sync.Mutex
+
 type Highlighter_Data struct {
 
 	// types
@@ -35,48 +38,56 @@ type Highlighter struct {
 }
 
 func load_syntax(name string) *Highlighter {
+	syntax_mutex.Lock()
+	defer syntax_mutex.Unlock()
+
 	if h, ok := SyntaxList[name]; ok {
 		return h
 	}
 
 	var data Highlighter_Data
+	var compiled Highlighter
 
 	path := `_data/syntax/` + name + `.json`
 
+	// a missing or broken syntax file leaves
+	// the code block unhighlighted
 	if file_exists(path) {
-		err := json.Unmarshal(load_file_bytes(path), &data)
+		source := load_file_bytes(path)
+		err    := json.Unmarshal(source, &data)
 
 		if err != nil {
-			panic(sub_sprint(`failed to parse JSON in "%s"\nerror: "%s"`, path, err.Error()))
+			json_error(path, source, err)
 		}
 	} else {
-		panic(`no such syntax file ` + name)
+		file_error(path, `no such syntax file ` + name)
 	}
 
-	var compiled Highlighter
+	compile := func(list []string) []*regexp.Regexp {
+		var out []*regexp.Regexp
 
-	for _, d := range data.String {
-		compiled.String = append(compiled.String, regexp.MustCompile(d))
-	}
-	for _, d := range data.Entity {
-		compiled.Entity = append(compiled.Entity, regexp.MustCompile(d))
-	}
-	for _, d := range data.Builtin {
-		compiled.Builtin = append(compiled.Builtin, regexp.MustCompile(d))
-	}
-	for _, d := range data.Keyword {
-		compiled.Keyword = append(compiled.Keyword, regexp.MustCompile(d))
-	}
-	for _, d := range data.Number {
-		compiled.Number = append(compiled.Number, regexp.MustCompile(d))
-	}
-	for _, d := range data.Boolean {
-		compiled.Boolean = append(compiled.Boolean, regexp.MustCompile(d))
-	}
-	for _, d := range data.Comment {
-		compiled.Comment = append(compiled.Comment, regexp.MustCompile(d))
+		for _, d := range list {
+			r, err := regexp.Compile(d)
+
+			if err != nil {
+				file_error(path, err.Error())
+				continue
+			}
+
+			out = append(out, r)
+		}
+
+		return out
 	}
 
+	compiled.String  = compile(data.String)
+	compiled.Entity  = compile(data.Entity)
+	compiled.Builtin = compile(data.Builtin)
+	compiled.Keyword = compile(data.Keyword)
+	compiled.Number  = compile(data.Number)
+	compiled.Boolean = compile(data.Boolean)
+	compiled.Comment = compile(data.Comment)
+
 	SyntaxList[name] = &compiled
 
 	return &compiled
@@ -27,52 +27,100 @@ func make_element_id(source string) string {
 // and remaps them against a go map
 // hard argument determines whether unmatched
 // variables are left in the text
+//
+// values are escaped for wherever they land,
+// text, an attribute or a url; ${!name} and
+// the raw filter insert them untouched
 func mapmap(source string, ref_map map[string]string, hard bool) string {
 	if strings.IndexRune(source, '$') < 0 {
 		return source
 	}
 
+	var out     strings.Builder
+	var scanner Html_Scanner
+
 	input := source
-	list  := make(map[string]string)
 
 	for {
-		pos := strings.IndexRune(input, '$')
+		pos := strings.Index(input, "${")
 
 		if pos < 0 {
 			break
 		}
 
-		if input[pos+1] == '{' {
-			end     := strings.IndexRune(input[pos+1:], '}')
-			end_pos := pos + end + 2
+		end := strings.IndexRune(input[pos:], '}')
+
+		// unclosed variables are left as they
+		// are; the parser reports them with a
+		// line number
+		if end < 0 {
+			break
+		}
+
+		scanner.Feed(input[:pos])
+		out.WriteString(input[:pos])
+
+		variable := input[pos:pos+end+1]
+		input     = input[pos+end+1:]
+
+		id, filters := parse_filters(variable[2:len(variable)-1])
 
-			if end > 0 {
-				v := input[pos:end_pos]
-				list[v] = v
-			} else {
-				panic("bad variable") // @error
-			}
+		raw := strings.HasPrefix(id, "!")
 
-			input = input[end_pos:]
-		} else {
-			input = input[pos+1:]
+		if raw {
+			id = id[1:]
+		}
+
+		value, ok := ref_map[id]
+
+		if !ok {
+			value, ok = data_value(id)
+		}
+
+		if !ok && !hard {
+			scanner.Feed(variable)
+			out.WriteString(variable)
+			continue
 		}
+
+		if ok && strings.Contains(id, `image`) { // do image things in variables
+			value = image_checker(value)
+		}
+
+		// missing variables are empty, unless
+		// a default says otherwise
+		if len(filters) > 0 {
+			value = apply_filters(id, value, filters)
+		}
+
+		if !raw && !has_raw_filter(filters) {
+			context, at_start := scanner.Context()
+			value = escape_value(value, context, at_start)
+		}
+
+		scanner.Feed(value)
+		out.WriteString(value)
 	}
 
-	for _, variable := range list {
-		id := variable[2:len(variable)-1]
+	out.WriteString(input)
+
+	return out.String()
+}
+
+// splits a comma separated variable such
+// as "go, web, tooling" into its entries
+func split_list(v string) []string {
+	var list []string
+
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
 
-		if value, ok := ref_map[id]; ok {
-			if strings.Contains(id, `image`) { // do image things in variables
-				value = image_checker(value)
-			}
-			source = strings.ReplaceAll(source, variable, value)
-		} else if hard {
-			source = strings.ReplaceAll(source, variable, "")
+		if item != "" {
+			list = append(list, item)
 		}
 	}
 
-	return source
+	return list
 }
 
 // substitutes all matches of a specific
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"time"
+	"strings"
+	"strconv"
+)
+
+type Value_Type int
+
+const (
+	V_STRING Value_Type = iota
+	V_INT
+	V_FLOAT
+	V_DATE
+	V_LIST
+)
+
+// a page variable read as the type its text
+// looks like; Text is always the original
+type Value struct {
+	Type  Value_Type
+	Text  string
+
+	Int   int64
+	Float float64
+	Date  time.Time
+	List  []string
+}
+
+var date_formats = []string{
+	"2006-01-02",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	time.RFC3339,
+}
+
+func parse_date(v string) (time.Time, bool) {
+	v = strings.TrimSpace(v)
+
+	for _, f := range date_formats {
+		if t, err := time.Parse(f, v); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// ParseFloat also takes "inf", "nan" and hex,
+// none of which anybody means as a number
+func looks_numeric(v string) bool {
+	has_digit := false
+
+	for _, r := range v {
+		switch {
+			case r >= '0' && r <= '9':
+				has_digit = true
+			case strings.ContainsRune("+-.eE", r):
+			default:
+				return false
+		}
+	}
+	return has_digit
+}
+
+// a comma separated value only becomes a list
+// when it is written as one, "[go, web]", or
+// belongs to a taxonomy; titles keep their
+// commas
+func is_list_var(key, v string) bool {
+	if strings.HasPrefix(v, "[") && strings.HasSuffix(v, "]") {
+		return true
+	}
+	if config != nil {
+		if _, ok := config.Taxonomies[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func parse_value(key, v string) *Value {
+	value := &Value{Type: V_STRING, Text: v}
+	text  := strings.TrimSpace(v)
+
+	if is_list_var(key, text) {
+		value.Type = V_LIST
+		value.Text = list_text(v)
+		value.List = split_list(value.Text)
+		return value
+	}
+
+	if t, ok := parse_date(text); ok {
+		value.Type = V_DATE
+		value.Date = t
+		return value
+	}
+
+	if !looks_numeric(text) {
+		return value
+	}
+
+	if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+		value.Type  = V_INT
+		value.Int   = n
+		value.Float = float64(n)
+		return value
+	}
+
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		value.Type  = V_FLOAT
+		value.Float = f
+	}
+
+	return value
+}
+
+// lists are written back as "a, b" so that
+// ${tags} prints without the brackets
+func list_text(v string) string {
+	text := strings.TrimSpace(v)
+
+	if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+		return strings.Join(split_list(text[1:len(text)-1]), ", ")
+	}
+	return v
+}
+
+// the typed value of a page variable; values
+// parsed by the parser are reused as long as
+// nothing has changed the text since
+func typed_var(the_page *Page, key string) *Value {
+	text := the_page.Vars[key]
+
+	if v, ok := the_page.Typed[key]; ok && v.Text == text {
+		return v
+	}
+	return parse_value(key, text)
+}
+
+func is_number(v *Value) bool {
+	return v.Type == V_INT || v.Type == V_FLOAT
+}
+
+// orders two values by their types when they
+// share one, falling back to their text
+func compare_values(a, b *Value) int {
+	switch {
+		case a.Type == V_DATE && b.Type == V_DATE:
+			switch {
+				case a.Date.Before(b.Date): return -1
+				case a.Date.After(b.Date):  return 1
+			}
+			return 0
+
+		case is_number(a) && is_number(b):
+			if a.Type == V_INT && b.Type == V_INT {
+				switch {
+					case a.Int < b.Int: return -1
+					case a.Int > b.Int: return 1
+				}
+				return 0
+			}
+			switch {
+				case a.Float < b.Float: return -1
+				case a.Float > b.Float: return 1
+			}
+			return 0
+	}
+
+	return strings.Compare(a.Text, b.Text)
+}
+
+// the verb of the first %, past its flags,
+// width and precision: 'd' in "%05d items";
+// 0 when there is none
+func format_verb(format string) rune {
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+
+		i++
+
+		for i < len(format) && strings.IndexByte("+-# 0123456789.", format[i]) >= 0 {
+			i++
+		}
+
+		if i == len(format) {
+			return 0
+		}
+		if format[i] != '%' {
+			return rune(format[i])
+		}
+	}
+	return 0
+}
+
+// ${date|2006-01-02} and ${price|%.2f};
+// formats that don't fit the value leave it
+// as it is
+func format_value(v *Value, format string) string {
+	switch v.Type {
+		case V_DATE:
+			return v.Date.Format(format)
+
+		case V_INT, V_FLOAT:
+			switch verb := format_verb(format); {
+				case verb == 0:
+					break
+
+				case strings.ContainsRune("eEfFgG", verb):
+					return fmt.Sprintf(format, v.Float)
+
+				case strings.ContainsRune("dboxXc", verb):
+					if v.Type == V_INT {
+						return fmt.Sprintf(format, v.Int)
+					}
+					return fmt.Sprintf(format, int64(v.Float))
+
+				default:
+					return fmt.Sprintf(format, v.Text)
+			}
+	}
+
+	if v.Type == V_LIST {
+		return strings.Join(v.List, ", ")
+	}
+	return v.Text
+}
\ No newline at end of file
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"time"
+	"path/filepath"
+)
+
+const watch_interval = 250 * time.Millisecond
+
+var watch_roots = []string{
+	"_data/plates",
+	"_data/snippets",
+	"_data/functions",
+	"_data/syntax",
+	data_root,
+}
+
+// collects the modification time of every
+// file a build can read from, keyed by path
+func watch_snapshot() map[string]time.Time {
+	snapshot := make(map[string]time.Time, 64)
+
+	add := func(root string, list map[string]*File_Info) {
+		for _, f := range list {
+			snapshot[filepath.Join(root, f.Path)] = f.Mod
+		}
+	}
+
+	source, _ := walk(".", config.Extensions...)
+	add(".", source)
+
+	for _, root := range watch_roots {
+		list, _ := walk(root)
+		add(root, list)
+	}
+
+	for _, file := range config.Include {
+		if path_exists(file) {
+			list, _ := walk(file)
+			add(file, list)
+		} else if info, ok := file_data(file); ok {
+			snapshot[file] = info.ModTime()
+		}
+	}
+
+	if info, ok := file_data("_data/oko.json"); ok {
+		snapshot["_data/oko.json"] = info.ModTime()
+	}
+
+	return snapshot
+}
+
+func snapshot_changed(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return true
+	}
+	for path, t := range a {
+		if n, ok := b[path]; !ok || !n.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// throws away everything cached by the
+// previous build so nothing stale (a plate,
+// a committed snippet, a dependency) leaks
+// into the next one
+func reset_build() {
+	PageList    = make(map[string]*Page)
+	DepTree     = make(map[string][]string)
+	PlateList   = make(map[string]*Plate)
+	SyntaxList  = make(map[string]*Highlighter)
+	Snippets    = make(map[string]*Snippet)
+
+	secondary_renders = make(map[string]*Page)
+	Redirects         = make(map[string]*Page)
+
+	Diagnostics = nil
+}
+
+// polls the project forever, rebuilding
+// whenever a snapshot differs from the last;
+// reload re-reads _data/oko.json
+func do_watch(reload func() bool) {
+	fmt.Println("[ø] watching for changes...")
+	fmt.Println()
+
+	last := watch_snapshot()
+
+	for {
+		time.Sleep(watch_interval)
+
+		next := watch_snapshot()
+
+		if !snapshot_changed(last, next) {
+			continue
+		}
+
+		config_changed := !last["_data/oko.json"].Equal(next["_data/oko.json"])
+
+		last = next
+
+		if config_changed {
+			previous := config
+
+			Diagnostics = nil
+
+			if !reload() {
+				config = previous
+				print_diagnostics()
+				fmt.Println("[ø] could not load _data/oko.json, keeping the previous config")
+				fmt.Println()
+				continue
+			}
+		}
+
+		reset_build()
+		build()
+
+		reload_browsers()
+	}
+}
\ No newline at end of file